@@ -0,0 +1,66 @@
+package sprout
+
+import (
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+)
+
+// subscriptionFinisher is implemented by stores (such as SubscriberStore)
+// that can end a subscription after delivering its queued notifications.
+type subscriptionFinisher interface {
+	FinishSubscription(Subscription)
+}
+
+// Backlog records the nodes added to a store while no Worker is connected
+// to a particular peer, so that they can be announced to that peer once a
+// new connection is established. See Worker.RestoreSession.
+type Backlog struct {
+	sync.Mutex
+	store        SubscribableStore
+	subscription Subscription
+	limit        int
+	nodes        []forest.Node
+	overflowed   bool
+}
+
+// RecordBacklog begins recording nodes added to the given store. At most
+// limit nodes will be retained; later nodes are discarded and the backlog
+// is marked as incomplete.
+func RecordBacklog(store SubscribableStore, limit int) *Backlog {
+	b := &Backlog{
+		store: store,
+		limit: limit,
+		nodes: make([]forest.Node, 0, limit),
+	}
+	b.subscription = store.SubscribeToNewMessages(b.record)
+	return b
+}
+
+func (b *Backlog) record(node forest.Node) {
+	b.Lock()
+	defer b.Unlock()
+	if len(b.nodes) >= b.limit {
+		b.overflowed = true
+		return
+	}
+	b.nodes = append(b.nodes, node)
+}
+
+// Stop ends recording and returns the recorded nodes in the order in which
+// they were added. The complete return value is false if nodes were
+// discarded because the backlog reached its limit.
+//
+// If the store supports it (as SubscriberStore does), the nodes added before
+// Stop was called are recorded before it returns, even if they were still
+// waiting to be delivered to the backlog. Otherwise they may be discarded.
+func (b *Backlog) Stop() (nodes []forest.Node, complete bool) {
+	if finisher, ok := b.store.(subscriptionFinisher); ok {
+		finisher.FinishSubscription(b.subscription)
+	} else {
+		b.store.UnsubscribeToNewMessages(b.subscription)
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.nodes, !b.overflowed
+}
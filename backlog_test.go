@@ -0,0 +1,47 @@
+package sprout_test
+
+import (
+	"testing"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestBacklog(t *testing.T) {
+	var nodes []forest.Node
+	for i := 0; i < 10; i++ {
+		identity, community, reply := testTree(t)
+		nodes = append(nodes, identity, community, reply)
+	}
+	store := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	backlog := sprout.RecordBacklog(store, len(nodes))
+	for _, node := range nodes {
+		if err := store.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	// every node added before Stop is recorded, even if still queued
+	recorded, complete := backlog.Stop()
+	if !complete || len(recorded) != len(nodes) {
+		t.Fatalf("expected %d recorded nodes, got %d (complete: %v)", len(nodes), len(recorded), complete)
+	}
+	for i, node := range recorded {
+		if !node.Equals(nodes[i]) {
+			t.Fatalf("expected node %d to be %s, got %s", i, nodes[i].ID(), node.ID())
+		}
+	}
+	if len(store.ActiveSubscriptions()) != 0 {
+		t.Fatalf("expected the backlog to unsubscribe")
+	}
+
+	limited := sprout.RecordBacklog(store, 1)
+	identity, community, _ := testTree(t)
+	for _, node := range []forest.Node{identity, community} {
+		if err := store.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if recorded, complete := limited.Stop(); complete || len(recorded) != 1 || !recorded[0].Equals(identity) {
+		t.Fatalf("expected an incomplete backlog holding the first node, got %d nodes (complete: %v)", len(recorded), complete)
+	}
+}
@@ -0,0 +1,192 @@
+package sprout
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// CacheStats reports the effectiveness of a CachingStore.
+type CacheStats struct {
+	// Hits counts lookups answered from the cache.
+	Hits uint64
+	// Misses counts lookups passed to the underlying store.
+	Misses uint64
+	// Evictions counts nodes removed to make room for others.
+	Evictions uint64
+	// Entries is the number of nodes currently cached.
+	Entries int
+}
+
+// CachingStore is a forest.Store that keeps the most recently used nodes
+// of another store in memory, so that frequently requested nodes (such as
+// the identities that sign many other nodes) are not repeatedly read from
+// disk and parsed. It is safe for concurrent use, so it can be placed
+// beneath a SubscriberStore.
+//
+// Only lookups of individual nodes are cached. Children and Recent always
+// consult the underlying store, as do lookups of nodes that are missing
+// (they may be added to the underlying store by another process).
+type CachingStore struct {
+	store    forest.Store
+	lock     sync.Mutex
+	capacity int
+	// order holds forest.Node values, least recently used first
+	order   *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+var _ forest.Store = &CachingStore{}
+
+// NewCachingStore wraps the given store with a cache of up to capacity
+// nodes.
+func NewCachingStore(store forest.Store, capacity int) *CachingStore {
+	return &CachingStore{
+		store:    store,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Stats returns the cache's activity so far.
+func (c *CachingStore) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+// lookup returns the cached node with the given ID if it satisfies the
+// given predicate, recording the outcome in the stats.
+func (c *CachingStore) lookup(id *fields.QualifiedHash, matches func(forest.Node) bool) (forest.Node, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, has := c.entries[id.String()]
+	if !has || !matches(element.Value.(forest.Node)) {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToBack(element)
+	return element.Value.(forest.Node), true
+}
+
+// remember caches the given node, evicting the least recently used nodes if
+// the cache is full.
+func (c *CachingStore) remember(node forest.Node) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := node.ID().String()
+	if element, has := c.entries[key]; has {
+		c.order.MoveToBack(element)
+		return
+	}
+	c.entries[key] = c.order.PushBack(node)
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Front()
+		delete(c.entries, oldest.Value.(forest.Node).ID().String())
+		c.order.Remove(oldest)
+		c.stats.Evictions++
+	}
+}
+
+// get answers a lookup of the node with the given ID from the cache if
+// possible, and otherwise from the given function, caching the result.
+func (c *CachingStore) get(id *fields.QualifiedHash, matches func(forest.Node) bool, fetch func() (forest.Node, bool, error)) (forest.Node, bool, error) {
+	if node, has := c.lookup(id, matches); has {
+		return node, true, nil
+	}
+	node, has, err := fetch()
+	if err != nil || !has {
+		return node, has, err
+	}
+	c.remember(node)
+	return node, true, nil
+}
+
+func anyNode(forest.Node) bool {
+	return true
+}
+
+func isIdentity(node forest.Node) bool {
+	_, ok := node.(*forest.Identity)
+	return ok
+}
+
+func isCommunity(node forest.Node) bool {
+	_, ok := node.(*forest.Community)
+	return ok
+}
+
+func (c *CachingStore) CopyInto(other forest.Store) error {
+	return c.store.CopyInto(other)
+}
+
+func (c *CachingStore) Get(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return c.get(id, anyNode, func() (forest.Node, bool, error) {
+		return c.store.Get(id)
+	})
+}
+
+func (c *CachingStore) GetIdentity(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return c.get(id, isIdentity, func() (forest.Node, bool, error) {
+		return c.store.GetIdentity(id)
+	})
+}
+
+func (c *CachingStore) GetCommunity(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	return c.get(id, isCommunity, func() (forest.Node, bool, error) {
+		return c.store.GetCommunity(id)
+	})
+}
+
+func (c *CachingStore) GetConversation(communityID, conversationID *fields.QualifiedHash) (forest.Node, bool, error) {
+	isConversation := func(node forest.Node) bool {
+		reply, ok := node.(*forest.Reply)
+		return ok && reply.Depth == 1 && reply.CommunityID.Equals(communityID)
+	}
+	return c.get(conversationID, isConversation, func() (forest.Node, bool, error) {
+		return c.store.GetConversation(communityID, conversationID)
+	})
+}
+
+func (c *CachingStore) GetReply(communityID, conversationID, replyID *fields.QualifiedHash) (forest.Node, bool, error) {
+	isReply := func(node forest.Node) bool {
+		reply, ok := node.(*forest.Reply)
+		return ok && reply.CommunityID.Equals(communityID) && reply.ConversationID.Equals(conversationID)
+	}
+	return c.get(replyID, isReply, func() (forest.Node, bool, error) {
+		return c.store.GetReply(communityID, conversationID, replyID)
+	})
+}
+
+func (c *CachingStore) Children(id *fields.QualifiedHash) ([]*fields.QualifiedHash, error) {
+	return c.store.Children(id)
+}
+
+func (c *CachingStore) Recent(nodeType fields.NodeType, quantity int) ([]forest.Node, error) {
+	return c.store.Recent(nodeType, quantity)
+}
+
+// Add inserts the node into the underlying store and caches it.
+func (c *CachingStore) Add(node forest.Node) error {
+	if err := c.store.Add(node); err != nil {
+		return err
+	}
+	c.remember(node)
+	return nil
+}
+
+// Close closes the underlying store if it implements io.Closer.
+func (c *CachingStore) Close() error {
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
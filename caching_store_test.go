@@ -0,0 +1,49 @@
+package sprout_test
+
+import (
+	"testing"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestCachingStore(t *testing.T) {
+	identity, community, reply := testTree(t)
+	backing := forest.NewMemoryStore()
+	for _, node := range []forest.Node{identity, community} {
+		if err := backing.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	cache := sprout.NewCachingStore(backing, 2)
+
+	for i := 0; i < 2; i++ {
+		node, has, err := cache.GetIdentity(identity.ID())
+		if err != nil || !has || !node.Equals(identity) {
+			t.Fatalf("expected identity, got %v %v %v", node, has, err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("expected one hit and one miss, got %+v", stats)
+	}
+
+	if err := cache.Add(reply); err != nil {
+		t.Fatalf("failed adding reply: %v", err)
+	}
+	if _, has, _ := backing.Get(reply.ID()); !has {
+		t.Fatalf("expected reply to be added to underlying store")
+	}
+	if _, has, err := cache.GetCommunity(community.ID()); err != nil || !has {
+		t.Fatalf("expected community, got %v %v", has, err)
+	}
+	stats := cache.Stats()
+	if stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("expected the identity to be evicted, got %+v", stats)
+	}
+	if _, has, err := cache.GetReply(&reply.CommunityID, &reply.ConversationID, reply.ID()); err != nil || !has {
+		t.Fatalf("expected reply, got %v %v", has, err)
+	}
+	if after := cache.Stats(); after.Hits != stats.Hits+1 {
+		t.Fatalf("expected reply to be served from the cache, got %+v", after)
+	}
+}
@@ -0,0 +1,253 @@
+package sprout
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+)
+
+// Sequence numbers the changes made to a SubscriberStore. The first change
+// is numbered 1, so the zero Sequence refers to the state before any change.
+type Sequence uint64
+
+// Change records the insertion of a node into a SubscriberStore.
+type Change struct {
+	Sequence Sequence
+	Node     forest.Node
+}
+
+// ErrChangesUnavailable is wrapped by the error returned when the changes
+// requested from a ChangeLog have already been discarded.
+var ErrChangesUnavailable = errors.New("changes no longer available in change log")
+
+// ChangeLog records the changes made to a SubscriberStore so that they can
+// be replayed later. Implementations must be safe for concurrent use, as
+// changes may be read with Since while another is appended.
+type ChangeLog interface {
+	// Append records a change. Changes are appended in order of increasing
+	// sequence number.
+	Append(Change) error
+	// Since returns every change with a sequence number greater than the
+	// given one, in order. It returns an error wrapping
+	// ErrChangesUnavailable if some of those changes are no longer held.
+	Since(Sequence) ([]Change, error)
+	// Last returns the sequence number of the most recent change, or zero
+	// if there are none.
+	Last() Sequence
+}
+
+// defaultChangeLogCapacity is the number of changes held by the change log
+// that NewSubscriberStore creates.
+const defaultChangeLogCapacity = 4096
+
+// MemoryChangeLog holds a bounded number of the most recent changes in
+// memory.
+type MemoryChangeLog struct {
+	sync.RWMutex
+	capacity int
+	changes  []Change
+	// last is the sequence number of the most recent change, which is
+	// tracked separately so that it survives the changes being discarded
+	last Sequence
+}
+
+var _ ChangeLog = &MemoryChangeLog{}
+
+// NewMemoryChangeLog creates a change log that holds up to capacity of
+// the most recent changes.
+func NewMemoryChangeLog(capacity int) *MemoryChangeLog {
+	return &MemoryChangeLog{
+		capacity: capacity,
+		changes:  make([]Change, 0, capacity),
+	}
+}
+
+// Append records a change, discarding the oldest change if the log is full.
+func (l *MemoryChangeLog) Append(change Change) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.capacity < 1 {
+		l.last = change.Sequence
+		return nil
+	}
+	if len(l.changes) >= l.capacity {
+		// append reallocates once the front of the slice is exhausted,
+		// which amortizes the cost of discarding changes
+		l.changes[0] = Change{}
+		l.changes = l.changes[1:]
+	}
+	l.changes = append(l.changes, change)
+	l.last = change.Sequence
+	return nil
+}
+
+// Since returns every held change after the given sequence number.
+func (l *MemoryChangeLog) Since(since Sequence) ([]Change, error) {
+	l.RLock()
+	defer l.RUnlock()
+	if since >= l.last {
+		return nil, nil
+	}
+	if len(l.changes) == 0 || l.changes[0].Sequence > since+1 {
+		return nil, fmt.Errorf("%w: requested changes after %d", ErrChangesUnavailable, since)
+	}
+	start := sort.Search(len(l.changes), func(i int) bool {
+		return l.changes[i].Sequence > since
+	})
+	changes := make([]Change, len(l.changes)-start)
+	copy(changes, l.changes[start:])
+	return changes, nil
+}
+
+// Last returns the sequence number of the most recent change.
+func (l *MemoryChangeLog) Last() Sequence {
+	l.RLock()
+	defer l.RUnlock()
+	return l.last
+}
+
+// FileChangeLog persists every change to an append-only file, so that the
+// sequence numbers of a SubscriberStore continue across restarts and any
+// past change can be replayed.
+//
+// Each record in the file is the big-endian sequence number (8 bytes), the
+// big-endian length of the node (4 bytes), and the node's binary encoding.
+type FileChangeLog struct {
+	sync.RWMutex
+	file *os.File
+	// sequences and offsets hold the sequence number and file offset of
+	// each record, in order
+	sequences []Sequence
+	offsets   []int64
+	size      int64
+}
+
+var _ ChangeLog = &FileChangeLog{}
+
+const changeRecordHeaderSize = 8 + 4
+
+// OpenFileChangeLog opens (creating if necessary) the change log stored in
+// the file at the given path. Torn records at the end of the file, left by
+// an interrupted write, are truncated away. A record is torn if it is
+// incomplete, if it does not follow its predecessor's sequence number, or
+// if it is the last record and its node cannot be decoded.
+func OpenFileChangeLog(path string) (*FileChangeLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0660)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening change log %s: %w", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed checking size of change log %s: %w", path, err)
+	}
+	l := &FileChangeLog{file: file}
+	header := make([]byte, changeRecordHeaderSize)
+	for {
+		if _, err := file.ReadAt(header, l.size); err != nil {
+			break
+		}
+		sequence := Sequence(binary.BigEndian.Uint64(header))
+		length := int64(binary.BigEndian.Uint32(header[8:]))
+		if length == 0 || l.size+changeRecordHeaderSize+length > info.Size() {
+			break
+		}
+		if last := len(l.sequences) - 1; last >= 0 && sequence <= l.sequences[last] {
+			// a region that was allocated but never written, such as
+			// after a crash, reads as zeroes
+			break
+		}
+		l.sequences = append(l.sequences, sequence)
+		l.offsets = append(l.offsets, l.size)
+		l.size += changeRecordHeaderSize + length
+	}
+	// the last record may have the right length but contents that never
+	// reached the disk
+	if last := len(l.sequences) - 1; last >= 0 {
+		if _, err := l.Since(l.sequences[last] - 1); err != nil {
+			l.size = l.offsets[last]
+			l.sequences = l.sequences[:last]
+			l.offsets = l.offsets[:last]
+		}
+	}
+	if err := file.Truncate(l.size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed discarding incomplete record in change log %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Append writes a change to the end of the file.
+func (l *FileChangeLog) Append(change Change) error {
+	data, err := change.Node.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed serializing node %s: %w", change.Node.ID(), err)
+	}
+	record := make([]byte, changeRecordHeaderSize+len(data))
+	binary.BigEndian.PutUint64(record, uint64(change.Sequence))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(data)))
+	copy(record[changeRecordHeaderSize:], data)
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.file.WriteAt(record, l.size); err != nil {
+		// discard whatever part of the record was written, so that it is
+		// not mistaken for a record when the file is reopened
+		if truncateErr := l.file.Truncate(l.size); truncateErr != nil {
+			return fmt.Errorf("failed writing change %d: %v (and failed discarding the partial record: %v)", change.Sequence, err, truncateErr)
+		}
+		return fmt.Errorf("failed writing change %d: %w", change.Sequence, err)
+	}
+	l.sequences = append(l.sequences, change.Sequence)
+	l.offsets = append(l.offsets, l.size)
+	l.size += int64(len(record))
+	return nil
+}
+
+// Since reads every change after the given sequence number from the file.
+func (l *FileChangeLog) Since(since Sequence) ([]Change, error) {
+	l.RLock()
+	defer l.RUnlock()
+	start := sort.Search(len(l.sequences), func(i int) bool {
+		return l.sequences[i] > since
+	})
+	changes := make([]Change, 0, len(l.sequences)-start)
+	for i := start; i < len(l.sequences); i++ {
+		end := l.size
+		if i+1 < len(l.offsets) {
+			end = l.offsets[i+1]
+		}
+		data := make([]byte, end-l.offsets[i]-changeRecordHeaderSize)
+		if _, err := l.file.ReadAt(data, l.offsets[i]+changeRecordHeaderSize); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed reading change %d: %w", l.sequences[i], err)
+		}
+		node, err := forest.UnmarshalBinaryNode(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed decoding change %d: %w", l.sequences[i], err)
+		}
+		changes = append(changes, Change{Sequence: l.sequences[i], Node: node})
+	}
+	return changes, nil
+}
+
+// Last returns the sequence number of the most recent change in the file.
+func (l *FileChangeLog) Last() Sequence {
+	l.RLock()
+	defer l.RUnlock()
+	if len(l.sequences) == 0 {
+		return 0
+	}
+	return l.sequences[len(l.sequences)-1]
+}
+
+// Close closes the underlying file.
+func (l *FileChangeLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
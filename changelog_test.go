@@ -0,0 +1,226 @@
+package sprout_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestFileChangeLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changelog")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes")
+	identity, community, reply := testTree(t)
+
+	changes, err := sprout.OpenFileChangeLog(path)
+	if err != nil {
+		t.Fatalf("failed opening change log: %v", err)
+	}
+	s := sprout.NewSubscriberStoreWithChangeLog(forest.NewMemoryStore(), changes)
+	for _, node := range []forest.Node{identity, community} {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if err := changes.Close(); err != nil {
+		t.Fatalf("failed closing change log: %v", err)
+	}
+	// simulate a write interrupted partway through a record
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed opening change log file: %v", err)
+	}
+	if _, err := file.Write([]byte{0, 0, 0}); err != nil {
+		t.Fatalf("failed corrupting change log: %v", err)
+	}
+	file.Close()
+
+	changes, err = sprout.OpenFileChangeLog(path)
+	if err != nil {
+		t.Fatalf("failed reopening change log: %v", err)
+	}
+	defer changes.Close()
+	s = sprout.NewSubscriberStoreWithChangeLog(forest.NewMemoryStore(), changes)
+	if s.Sequence() != 2 {
+		t.Fatalf("expected sequence to resume at 2, got %d", s.Sequence())
+	}
+	if err := s.Add(reply); err != nil {
+		t.Fatalf("failed adding reply: %v", err)
+	}
+	since, err := s.ChangesSince(1)
+	if err != nil {
+		t.Fatalf("failed listing changes: %v", err)
+	}
+	if len(since) != 2 || since[0].Sequence != 2 || !since[0].Node.Equals(community) ||
+		since[1].Sequence != 3 || !since[1].Node.Equals(reply) {
+		t.Fatalf("unexpected changes since 1: %v", since)
+	}
+}
+
+func TestFileChangeLogTruncatedTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "changelog")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "changes")
+	identity, community, reply := testTree(t)
+
+	changes, err := sprout.OpenFileChangeLog(path)
+	if err != nil {
+		t.Fatalf("failed opening change log: %v", err)
+	}
+	for i, node := range []forest.Node{identity, community} {
+		if err := changes.Append(sprout.Change{Sequence: sprout.Sequence(i + 1), Node: node}); err != nil {
+			t.Fatalf("failed appending change: %v", err)
+		}
+	}
+	changes.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed checking change log size: %v", err)
+	}
+	intact := info.Size()
+
+	for _, corrupt := range []struct {
+		name    string
+		corrupt func(*os.File) error
+	}{
+		{"truncated record", func(file *os.File) error {
+			if err := changes.Append(sprout.Change{Sequence: 3, Node: reply}); err != nil {
+				return err
+			}
+			// keep the header and the start of the node
+			return file.Truncate(intact + 20)
+		}},
+		{"zeroed record", func(file *os.File) error {
+			_, err := file.WriteAt(make([]byte, 64), intact)
+			return err
+		}},
+		{"garbled record", func(file *os.File) error {
+			record := []byte{0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff}
+			_, err := file.WriteAt(record, intact)
+			return err
+		}},
+	} {
+		changes, err = sprout.OpenFileChangeLog(path)
+		if err != nil {
+			t.Fatalf("failed opening change log: %v", err)
+		}
+		file, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("failed opening change log file: %v", err)
+		}
+		if err := corrupt.corrupt(file); err != nil {
+			t.Fatalf("failed corrupting change log with a %s: %v", corrupt.name, err)
+		}
+		file.Close()
+		changes.Close()
+
+		changes, err = sprout.OpenFileChangeLog(path)
+		if err != nil {
+			t.Fatalf("failed reopening change log after a %s: %v", corrupt.name, err)
+		}
+		if last := changes.Last(); last != 2 {
+			t.Fatalf("expected the %s to be discarded, last change is %d", corrupt.name, last)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != intact {
+			t.Fatalf("expected the %s to be truncated away: %v", corrupt.name, err)
+		}
+		since, err := changes.Since(0)
+		if err != nil || len(since) != 2 || !since[1].Node.Equals(community) {
+			t.Fatalf("expected the intact changes to remain after a %s, got %v: %v", corrupt.name, since, err)
+		}
+		changes.Close()
+	}
+}
+
+func TestSubscribeFromSequence(t *testing.T) {
+	identity, community, reply := testTree(t)
+	s := sprout.NewSubscriberStoreWithChangeLog(forest.NewMemoryStore(), sprout.NewMemoryChangeLog(1))
+	for _, node := range []forest.Node{identity, community} {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if _, err := s.ChangesSince(0); !errors.Is(err, sprout.ErrChangesUnavailable) {
+		t.Fatalf("expected discarded changes to be unavailable, got %v", err)
+	}
+	received := make(chan forest.Node, 2)
+	if _, err := s.SubscribeFromSequence(1, nil, func(n forest.Node) {
+		received <- n
+	}); err != nil {
+		t.Fatalf("failed subscribing from sequence 1: %v", err)
+	}
+	if err := s.Add(reply); err != nil {
+		t.Fatalf("failed adding reply: %v", err)
+	}
+	for _, expected := range []forest.Node{community, reply} {
+		select {
+		case n := <-received:
+			if !n.Equals(expected) {
+				t.Fatalf("expected %T, got %T", expected, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %T", expected)
+		}
+	}
+}
+
+func TestSubscribeFromSequenceDuringInsertion(t *testing.T) {
+	var nodes []forest.Node
+	for i := 0; i < 20; i++ {
+		identity, community, reply := testTree(t)
+		nodes = append(nodes, identity, community, reply)
+	}
+	s := sprout.NewSubscriberStoreWithChangeLog(forest.NewMemoryStore(), sprout.NewMemoryChangeLog(len(nodes)))
+	half := len(nodes) / 2
+	for _, node := range nodes[:half] {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	added := make(chan error, 1)
+	go func() {
+		for _, node := range nodes[half:] {
+			if err := s.Add(node); err != nil {
+				added <- err
+				return
+			}
+		}
+		added <- nil
+	}()
+	received := make(chan forest.Node, len(nodes))
+	if _, err := s.SubscribeFromSequence(0, nil, func(n forest.Node) {
+		received <- n
+	}); err != nil {
+		t.Fatalf("failed subscribing from sequence 0: %v", err)
+	}
+	if err := <-added; err != nil {
+		t.Fatalf("failed adding node: %v", err)
+	}
+	for i, expected := range nodes {
+		select {
+		case n := <-received:
+			if !n.Equals(expected) {
+				t.Fatalf("expected node %d to be %s, got %s", i, expected.ID(), n.ID())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for node %d", i)
+		}
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("received unexpected duplicate %s", n.ID())
+	case <-time.After(10 * time.Millisecond):
+	}
+}
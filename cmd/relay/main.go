@@ -8,9 +8,13 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
 	"git.sr.ht/~whereswaldon/forest-go/grove"
 	sprout "git.sr.ht/~whereswaldon/sprout-go"
 	"git.sr.ht/~whereswaldon/sprout-go/watch"
@@ -20,6 +24,106 @@ func tickerChan(seconds int) <-chan time.Time {
 	return time.NewTicker(time.Second * time.Duration(seconds)).C
 }
 
+// parseNodeIDs converts a comma-separated list of node IDs into their
+// parsed representation.
+func parseNodeIDs(list string) ([]*fields.QualifiedHash, error) {
+	ids := []*fields.QualifiedHash{}
+	for _, idString := range strings.Split(list, ",") {
+		idString = strings.TrimSpace(idString)
+		if idString == "" {
+			continue
+		}
+		id := &fields.QualifiedHash{}
+		if err := id.UnmarshalText([]byte(idString)); err != nil {
+			return nil, fmt.Errorf("failed parsing node id %s: %w", idString, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// subscriptionPolicy builds the policy described by the allow and deny
+// community lists. It returns nil if neither list is populated.
+func subscriptionPolicy(allow, deny string) (sprout.SubscriptionPolicy, error) {
+	allowed, err := parseNodeIDs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseNodeIDs(deny)
+	if err != nil {
+		return nil, err
+	}
+	policies := []sprout.SubscriptionPolicy{}
+	if len(allowed) > 0 {
+		policies = append(policies, sprout.AllowCommunities(allowed...))
+	}
+	if len(denied) > 0 {
+		policies = append(policies, sprout.DenyCommunities(denied...))
+	}
+	switch len(policies) {
+	case 0:
+		return nil, nil
+	case 1:
+		return policies[0], nil
+	default:
+		return sprout.AllPolicies(policies...), nil
+	}
+}
+
+// contentPolicy builds the content policy described by the given flag
+// values. It returns nil if none of them impose any restriction.
+func contentPolicy(blockedIdentities, blockedCommunities string, maxContentSize, maxDepth int, timestamps sprout.TimestampPolicy) (sprout.ContentPolicy, error) {
+	policies := []sprout.ContentPolicy{}
+	identities, err := parseNodeIDs(blockedIdentities)
+	if err != nil {
+		return nil, err
+	}
+	if len(identities) > 0 {
+		policies = append(policies, sprout.NewIdentityBlocklist(identities...))
+	}
+	communities, err := parseNodeIDs(blockedCommunities)
+	if err != nil {
+		return nil, err
+	}
+	if len(communities) > 0 {
+		policies = append(policies, sprout.NewCommunityBlocklist(communities...))
+	}
+	if maxContentSize > 0 {
+		policies = append(policies, sprout.MaxContentSize(maxContentSize))
+	}
+	if maxDepth > 0 {
+		policies = append(policies, sprout.MaxTreeDepth(maxDepth))
+	}
+	if timestamps.MaxSkew > 0 || timestamps.MaxAge > 0 {
+		policies = append(policies, timestamps)
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	return sprout.ContentPolicies(policies...), nil
+}
+
+// reportProvenance logs the contribution of each peer to the given index
+// every interval until done is closed.
+func reportProvenance(provenance *sprout.ProvenanceIndex, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for peer, contribution := range provenance.Peers() {
+			log.Printf("Peer %s contributed %d nodes (%d announced, %d ancestry, %d queried, %d bootstrap), latest at %s",
+				peer, contribution.Nodes,
+				contribution.Via[sprout.ViaAnnounce], contribution.Via[sprout.ViaAncestry],
+				contribution.Via[sprout.ViaQuery], contribution.Via[sprout.ViaBootstrap],
+				contribution.Latest.Format(time.RFC3339))
+		}
+	}
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	wd, _ := os.Getwd()
@@ -29,6 +133,34 @@ func main() {
 	insecure := flag.Bool("insecure", false, "Don't verify the TLS certificates of addresses provided as arguments")
 	tlsPort := flag.Int("tls-port", 7777, "TLS listen port")
 	tlsIP := flag.String("tls-ip", "127.0.0.1", "TLS listen IP address")
+	subscribeTo := flag.String("subscribe", "", "Comma-separated list of community IDs to subscribe to (default all)")
+	ignore := flag.String("ignore", "", "Comma-separated list of community IDs never to subscribe to")
+	upstreamGrace := flag.Duration("upstream-grace", 5*time.Minute, "How long to stay subscribed upstream after the last downstream subscriber leaves a community")
+	validationWorkers := flag.Int("validation-workers", runtime.NumCPU(), "Number of nodes to validate in parallel")
+	syncAnnounce := flag.Bool("sync-announce", false, "Finish ingesting announced nodes before replying so that peers learn whether they were accepted")
+	blockIdentities := flag.String("block-identities", "", "Comma-separated list of identity IDs whose nodes will be rejected")
+	blockCommunities := flag.String("block-communities", "", "Comma-separated list of community IDs whose nodes will be rejected")
+	maxContentSize := flag.Int("max-content-size", 0, "Reject nodes with content or metadata longer than this many bytes (0 for no limit)")
+	maxDepth := flag.Int("max-depth", 0, "Reject nodes deeper than this in their tree (0 for no limit)")
+	var timestamps sprout.TimestampPolicy
+	flag.DurationVar(&timestamps.MaxSkew, "max-clock-skew", 0, "Reject nodes created further than this in the future (0 for no limit)")
+	flag.DurationVar(&timestamps.MaxAge, "max-age", 0, "Reject replies created longer ago than this, unless they are the ancestors of a newer node (0 for no limit)")
+	flag.BoolVar(&timestamps.FilterServe, "filter-served-timestamps", false, "Also refuse to send nodes rejected by -max-clock-skew or -max-age to peers")
+	maxSubscriptions := flag.Int("max-subscriptions", 0, "Maximum number of communities each peer may subscribe to (0 for no limit)")
+	provenanceReport := flag.Duration("provenance-report", 0, "How often to log the number of nodes contributed by each peer (0 to disable)")
+	provenanceNodes := flag.Int("provenance-nodes", 65536, "Number of recently inserted nodes whose peer and arrival to remember (0 for no limit)")
+	cacheSize := flag.Int("cache-size", 0, "Number of recently used nodes to keep in memory in front of the grove (0 to disable)")
+	indexCommunities := flag.Int("index-communities", 0, "Index the trees of up to this many communities in the grove at startup (and every node added afterward) to answer leaves_of requests without searching the grove (0 to disable)")
+	scopeLists := flag.Bool("scope-lists", false, "List only the replies in communities that the requesting peer is subscribed to (requires -index-communities)")
+	changeLogPath := flag.String("changelog", "", "File in which to record every node added to the grove, so that change sequence numbers survive restarts (default keep recent changes in memory)")
+	quarantinePath := flag.String("quarantine", "", "Directory in which to keep rejected nodes for inspection (default discard them)")
+	quarantineMax := flag.Int("quarantine-max", 10000, "Maximum number of nodes to keep in the quarantine, evicting the oldest first (0 for no limit)")
+	quarantineMaxPerPeer := flag.Int("quarantine-max-per-peer", 1000, "Maximum number of nodes from any one peer to keep in the quarantine, evicting that peer's oldest first (0 for no limit)")
+	var quarantineCmd quarantineCommand
+	flag.BoolVar(&quarantineCmd.List, "quarantine-list", false, "List the nodes in the quarantine directory and exit")
+	flag.StringVar(&quarantineCmd.Show, "quarantine-show", "", "Comma-separated list of quarantined node IDs to print in detail before exiting")
+	flag.StringVar(&quarantineCmd.Retry, "quarantine-retry", "", "Comma-separated list of quarantined node IDs (or \"all\") to validate again and insert into the grove before exiting")
+	flag.StringVar(&quarantineCmd.Purge, "quarantine-purge", "", "Remove quarantined nodes and exit: \"all\", a comma-separated list of node IDs, or a duration to remove nodes older than")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(),
 			`Usage:
@@ -43,6 +175,37 @@ and will establish Sprout connections to all addresses provided as arguments.
 	}
 	flag.Parse()
 
+	policy, err := subscriptionPolicy(*subscribeTo, *ignore)
+	if err != nil {
+		log.Fatalf("Failed parsing subscription policy: %v", err)
+	}
+	content, err := contentPolicy(*blockIdentities, *blockCommunities, *maxContentSize, *maxDepth, timestamps)
+	if err != nil {
+		log.Fatalf("Failed parsing content policy: %v", err)
+	}
+	var quarantine *sprout.Quarantine
+	if *quarantinePath != "" {
+		quarantine, err = sprout.NewQuarantine(*quarantinePath)
+		if err != nil {
+			log.Fatalf("Failed opening quarantine: %v", err)
+		}
+		quarantine.MaxRecords = *quarantineMax
+		quarantine.MaxRecordsPerPeer = *quarantineMaxPerPeer
+	}
+	if quarantineCmd.Requested() {
+		if quarantine == nil {
+			log.Fatalf("Managing the quarantine requires the -quarantine flag")
+		}
+		grove, err := grove.New(*grovePath)
+		if err != nil {
+			log.Fatalf("Failed to open grove at %s: %v", *grovePath, err)
+		}
+		if err := quarantineCmd.Run(quarantine, grove, os.Stdout); err != nil {
+			log.Fatalf("Failed managing quarantine: %v", err)
+		}
+		return
+	}
+
 	cert, err := tls.LoadX509KeyPair(*certpath, *keypath)
 	if err != nil {
 		log.Fatalf("Failed loading certs: %v", err)
@@ -71,8 +234,41 @@ and will establish Sprout connections to all addresses provided as arguments.
 	if err != nil {
 		log.Fatalf("Failed to create grove at %s: %v", *grovePath, err)
 	}
-	messages := sprout.NewSubscriberStore(grove)
-	defer messages.Destroy()
+	var store forest.Store = grove
+	if *cacheSize > 0 {
+		cache := sprout.NewCachingStore(grove, *cacheSize)
+		defer func() {
+			stats := cache.Stats()
+			log.Printf("Node cache served %d hits and %d misses, evicting %d nodes", stats.Hits, stats.Misses, stats.Evictions)
+		}()
+		store = cache
+	}
+	// index the grove's trees as nodes are inserted, so that requests can
+	// be answered without walking them
+	var index *sprout.TreeIndex
+	if *indexCommunities > 0 {
+		index = sprout.NewTreeIndex()
+		store = sprout.NewIndexingStore(store, index)
+	}
+	var messages *sprout.SubscriberStore
+	if *changeLogPath != "" {
+		changes, err := sprout.OpenFileChangeLog(*changeLogPath)
+		if err != nil {
+			log.Fatalf("Failed opening change log: %v", err)
+		}
+		messages = sprout.NewSubscriberStoreWithChangeLog(store, changes)
+		log.Printf("Resuming change log at sequence %d", messages.Sequence())
+	} else {
+		messages = sprout.NewSubscriberStore(store)
+	}
+	messages.OnSlowSubscriber = func(stats sprout.SubscriberStats) {
+		log.Printf("Subscriber %d is not keeping up with new nodes: %d queued, %d dropped, busy for %v", stats.Subscription, stats.Queued, stats.Dropped, stats.Busy)
+	}
+	defer func() {
+		if err := messages.Close(); err != nil {
+			log.Printf("Failed closing store: %v", err)
+		}
+	}()
 
 	// track node ids of nodes that we've recently inserted into the grove so that
 	// we know when a new FS write was us or another process
@@ -111,6 +307,26 @@ and will establish Sprout connections to all addresses provided as arguments.
 		}
 	})
 
+	// mirror the subscriptions of our downstream peers onto our upstream peers
+	upstream := NewUpstreamSubscriptions(*upstreamGrace, 1024, log.New(log.Writer(), "upstream ", log.Flags()))
+
+	// deduplicate ingestion work across every worker sharing our store
+	inflight := sprout.NewInflightGroup()
+	validation := sprout.NewValidationPool(*validationWorkers)
+	// track which peer contributed each node
+	provenance := sprout.NewProvenanceIndex()
+	provenance.MaxNodes = *provenanceNodes
+	if *provenanceReport > 0 {
+		go reportProvenance(provenance, *provenanceReport, done)
+	}
+	// index the trees already in the grove
+	if index != nil {
+		if err := index.Populate(messages, *indexCommunities); err != nil {
+			log.Fatalf("Failed indexing grove: %v", err)
+		}
+		log.Printf("Indexed %d nodes", index.Len())
+	}
+
 	// start listening for new connections
 	go func() {
 		workerCount := 0
@@ -127,7 +343,21 @@ and will establish Sprout connections to all addresses provided as arguments.
 				continue
 			}
 			worker.Logger = log.New(log.Writer(), fmt.Sprintf("worker-%d ", workerCount), log.Flags())
-			go worker.Run()
+			worker.SubscriptionPolicy = policy
+			worker.Inflight = inflight
+			worker.Validation = validation
+			worker.SynchronousAnnounce = *syncAnnounce
+			worker.ContentPolicy = content
+			worker.Quarantine = quarantine
+			worker.Provenance = provenance
+			worker.Index = index
+			worker.ScopeReplyLists = *scopeLists
+			worker.MaxPeerSubscriptions = *maxSubscriptions
+			upstream.AddDownstream(worker)
+			go func() {
+				worker.Run()
+				upstream.RemoveDownstream(worker)
+			}()
 			log.Printf("Launched worker-%d to handle new connection", workerCount)
 			workerCount++
 			select {
@@ -149,6 +379,12 @@ and will establish Sprout connections to all addresses provided as arguments.
 				}
 			}
 			firstAttempt := true
+			// state from the previous connection to this address, used to
+			// restore subscriptions and announce nodes missed while disconnected
+			var (
+				previous *sprout.Session
+				backlog  *sprout.Backlog
+			)
 			for {
 				if !firstAttempt {
 					log.Printf("Restarting worker for address %s", addr)
@@ -166,10 +402,71 @@ and will establish Sprout connections to all addresses provided as arguments.
 					continue
 				}
 				worker.Logger = log.New(log.Writer(), fmt.Sprintf("worker-%v ", addr), log.Flags())
-				go worker.BootstrapLocalStore(1024)
+				worker.PeerAddress = addr
+				worker.SubscriptionPolicy = policy
+				worker.Inflight = inflight
+				worker.Validation = validation
+				worker.SynchronousAnnounce = *syncAnnounce
+				worker.ContentPolicy = content
+				worker.Quarantine = quarantine
+				worker.Provenance = provenance
+				worker.Index = index
+				worker.ScopeReplyLists = *scopeLists
+				// register the worker for downstream demand only after restoring
+				// the previous session, so that restored subscriptions are not
+				// mistaken for demand-driven ones, and never after it has stopped
+				var (
+					registration sync.Mutex
+					stopped      bool
+				)
+				addUpstream := func() {
+					registration.Lock()
+					defer registration.Unlock()
+					if !stopped {
+						upstream.AddUpstream(worker)
+					}
+				}
+				if previous != nil {
+					go func(previous *sprout.Session, backlog *sprout.Backlog) {
+						// keep recording until the worker is subscribed to
+						// the store, so that every node added in between is
+						// either in the backlog or announced by the worker
+						<-worker.Ready()
+						missed, complete := backlog.Stop()
+						if !complete {
+							log.Printf("Backlog for %s overflowed, bootstrapping instead of restoring the previous session", addr)
+							addUpstream()
+							worker.BootstrapLocalStore(1024)
+							return
+						}
+						result := worker.RestoreSession(previous, missed, 1024)
+						log.Printf("Restored session with %s: resubscribed %d communities (%d failed), announced %d missed nodes", addr, len(result.Resubscribed), len(result.Failed), result.Announced)
+						for community, err := range result.Failed {
+							log.Printf("Failed resubscribing to %s on %s: %v", community, addr, err)
+						}
+						if result.AnnounceErr != nil {
+							log.Printf("Failed announcing missed nodes to %s: %v", addr, result.AnnounceErr)
+						}
+						addUpstream()
+						worker.BootstrapLocalStore(1024)
+					}(previous, backlog)
+				} else {
+					addUpstream()
+					go worker.BootstrapLocalStore(1024)
+				}
 
 				// block until the worker dies
 				worker.Run()
+				registration.Lock()
+				stopped = true
+				registration.Unlock()
+				// subscriptions made on behalf of downstream peers are restored
+				// by AddUpstream on the next connection if still in demand
+				for _, community := range upstream.RemoveUpstream(worker) {
+					worker.UnsubscribeLocal(community)
+				}
+				previous = worker.Session
+				backlog = sprout.RecordBacklog(messages, 1024)
 				select {
 				case <-done:
 					return
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/testkeys"
+)
+
+func testCommunity(t *testing.T, name string) *forest.Community {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, "relay-test", "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	community, err := forest.As(identity, signer).NewCommunity(name, "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	return community
+}
+
+func TestSubscriptionPolicyFlags(t *testing.T) {
+	a, b := testCommunity(t, "a"), testCommunity(t, "b")
+	aID, bID := a.ID().String(), b.ID().String()
+	for _, test := range []struct {
+		name          string
+		allow, deny   string
+		nilPolicy     bool
+		acceptA       bool
+		acceptB       bool
+		expectFailure bool
+	}{
+		{name: "no flags", nilPolicy: true},
+		{name: "allow", allow: aID, acceptA: true},
+		{name: "deny", deny: aID, acceptB: true},
+		{name: "allow both deny one", allow: aID + ", " + bID, deny: bID, acceptA: true},
+		{name: "blank entries", allow: "," + aID + ",", acceptA: true},
+		{name: "malformed", allow: "not-an-id", expectFailure: true},
+	} {
+		policy, err := subscriptionPolicy(test.allow, test.deny)
+		if test.expectFailure {
+			if err == nil {
+				t.Errorf("%s: expected parsing to fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed parsing policy: %v", test.name, err)
+			continue
+		}
+		if test.nilPolicy {
+			if policy != nil {
+				t.Errorf("%s: expected no policy, got %v", test.name, policy)
+			}
+			continue
+		}
+		if policy.ShouldSubscribe(a) != test.acceptA || policy.ShouldSubscribe(b) != test.acceptB {
+			t.Errorf("%s: expected a=%v b=%v, got a=%v b=%v", test.name, test.acceptA, test.acceptB, policy.ShouldSubscribe(a), policy.ShouldSubscribe(b))
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// quarantineCommand describes the quarantine management operations
+// requested on the command line.
+type quarantineCommand struct {
+	List  bool
+	Show  string
+	Retry string
+	Purge string
+}
+
+// Requested returns whether any quarantine operation was requested.
+func (q quarantineCommand) Requested() bool {
+	return q.List || q.Show != "" || q.Retry != "" || q.Purge != ""
+}
+
+// Run performs the requested operations on the given quarantine, writing
+// their results to out. Retried nodes are inserted into store.
+func (q quarantineCommand) Run(quarantine *sprout.Quarantine, store forest.Store, out io.Writer) error {
+	if q.List {
+		for _, record := range quarantine.List() {
+			fmt.Fprintf(out, "%s\t%T\t%s\t%s\t%s\n", record.Node.ID(), record.Node, record.Time.Format(time.RFC3339), record.Peer, record.Reason)
+		}
+	}
+	if q.Show != "" {
+		ids, err := parseNodeIDs(q.Show)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			record, has := quarantine.Get(id)
+			if !has {
+				return fmt.Errorf("node %s is not quarantined", id)
+			}
+			fmt.Fprintf(out, "id: %s\ntype: %T\nquarantined: %s\npeer: %s\nreason: %s\nnode: %+v\n\n",
+				id, record.Node, record.Time.Format(time.RFC3339), record.Peer, record.Reason, record.Node)
+		}
+	}
+	if q.Retry != "" {
+		records := []sprout.QuarantineRecord{}
+		if q.Retry == "all" {
+			records = quarantine.List()
+		} else {
+			ids, err := parseNodeIDs(q.Retry)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				record, has := quarantine.Get(id)
+				if !has {
+					return fmt.Errorf("node %s is not quarantined", id)
+				}
+				records = append(records, record)
+			}
+		}
+		// records are oldest first, which usually puts parents before
+		// their children
+		for _, record := range records {
+			if err := quarantine.Retry(record.Node.ID(), store); err != nil {
+				fmt.Fprintf(out, "retry failed: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(out, "restored %s\n", record.Node.ID())
+		}
+	}
+	if q.Purge != "" {
+		before := time.Now()
+		if q.Purge != "all" {
+			age, err := time.ParseDuration(q.Purge)
+			if err != nil {
+				ids, idErr := parseNodeIDs(q.Purge)
+				if idErr != nil {
+					return fmt.Errorf("quarantine purge must be \"all\", a duration, or node IDs: %w", idErr)
+				}
+				for _, id := range ids {
+					if err := quarantine.Remove(id); err != nil {
+						return err
+					}
+				}
+				fmt.Fprintf(out, "purged %d nodes\n", len(ids))
+				return nil
+			}
+			before = before.Add(-age)
+		}
+		purged, err := quarantine.Purge(before)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "purged %d nodes\n", purged)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// demand tracks how many downstream peers are subscribed to a community and
+// which upstream workers we subscribed to it on their behalf.
+type demand struct {
+	community   *fields.QualifiedHash
+	subscribers int
+	// release is non-nil while the grace period after the last downstream
+	// subscriber left is running
+	release *time.Timer
+	// propagated holds the upstream workers on which we subscribed to this
+	// community because of downstream demand
+	propagated map[*sprout.Worker]struct{}
+	// pending holds the upstream workers that are still subscribing to this
+	// community
+	pending map[*sprout.Worker]struct{}
+}
+
+// UpstreamSubscriptions aggregates the community subscriptions of all
+// downstream peers (those that connected to this relay) and mirrors them
+// onto every upstream peer (those that this relay dialed). When the first
+// downstream peer subscribes to a community, the relay subscribes to it
+// upstream and fetches its history. When the last downstream peer leaves,
+// the relay unsubscribes upstream after a grace period.
+//
+// Upstream subscriptions that were not created by UpstreamSubscriptions
+// (such as those made by BootstrapLocalStore) are never removed by it.
+type UpstreamSubscriptions struct {
+	sync.Mutex
+	// GracePeriod is how long to remain subscribed upstream after the last
+	// downstream subscriber leaves.
+	GracePeriod time.Duration
+	// FetchLimit is the maximum number of leaves to fetch when newly
+	// subscribing to a community upstream.
+	FetchLimit int
+	*log.Logger
+
+	demand    map[string]*demand
+	upstreams map[*sprout.Worker]struct{}
+	// downstreams holds the communities that each downstream worker is
+	// counted as subscribed to
+	downstreams map[*sprout.Worker]map[string]*fields.QualifiedHash
+}
+
+// NewUpstreamSubscriptions creates an empty subscription aggregator.
+func NewUpstreamSubscriptions(gracePeriod time.Duration, fetchLimit int, logger *log.Logger) *UpstreamSubscriptions {
+	return &UpstreamSubscriptions{
+		GracePeriod: gracePeriod,
+		FetchLimit:  fetchLimit,
+		Logger:      logger,
+		demand:      make(map[string]*demand),
+		upstreams:   make(map[*sprout.Worker]struct{}),
+		downstreams: make(map[*sprout.Worker]map[string]*fields.QualifiedHash),
+	}
+}
+
+// AddDownstream begins tracking the peer subscriptions of the given worker.
+// It must be called before the worker is run.
+//
+// Changes to the worker's subscriptions may be reported concurrently and
+// out of order, so each report is only used as a cue to compare the
+// worker's current subscription to the community with the demand counted
+// for it.
+func (u *UpstreamSubscriptions) AddDownstream(worker *sprout.Worker) {
+	u.Lock()
+	u.downstreams[worker] = make(map[string]*fields.QualifiedHash)
+	u.Unlock()
+	worker.OnSubscriptionChange = func(change sprout.SubscriptionChange) {
+		if change.Direction != sprout.PeerSubscription {
+			return
+		}
+		u.sync(worker, change.Community)
+	}
+}
+
+// RemoveDownstream releases all subscriptions held by the given worker and
+// stops tracking it, ignoring any changes to its subscriptions that are
+// reported afterward. It should be called once the worker has stopped
+// running.
+func (u *UpstreamSubscriptions) RemoveDownstream(worker *sprout.Worker) {
+	u.Lock()
+	defer u.Unlock()
+	for _, community := range u.downstreams[worker] {
+		u.release(community)
+	}
+	delete(u.downstreams, worker)
+}
+
+// sync counts the given downstream worker as subscribed to the community
+// if and only if it currently is.
+func (u *UpstreamSubscriptions) sync(worker *sprout.Worker, community *fields.QualifiedHash) {
+	u.Lock()
+	defer u.Unlock()
+	counted, tracked := u.downstreams[worker]
+	if !tracked {
+		// the worker has already been removed
+		return
+	}
+	key := community.String()
+	_, wasSubscribed := counted[key]
+	isSubscribed := worker.IsPeerSubscribed(community)
+	switch {
+	case isSubscribed && !wasSubscribed:
+		counted[key] = community
+		u.acquire(community)
+	case !isSubscribed && wasSubscribed:
+		delete(counted, key)
+		u.release(community)
+	}
+}
+
+// AddUpstream registers a worker connected to an upstream peer and
+// subscribes it to every community that downstream peers are currently
+// subscribed to.
+func (u *UpstreamSubscriptions) AddUpstream(worker *sprout.Worker) {
+	u.Lock()
+	defer u.Unlock()
+	u.upstreams[worker] = struct{}{}
+	for _, d := range u.demand {
+		u.propagate(d, worker)
+	}
+}
+
+// RemoveUpstream stops tracking the given upstream worker. It returns the
+// communities that the worker was subscribed to (or was subscribing to)
+// only because of downstream demand. Those subscriptions should not be
+// restored on a new connection to the same peer, as AddUpstream subscribes
+// to them again if they are still in demand.
+func (u *UpstreamSubscriptions) RemoveUpstream(worker *sprout.Worker) []*fields.QualifiedHash {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.upstreams, worker)
+	propagated := []*fields.QualifiedHash{}
+	for _, d := range u.demand {
+		_, isPropagated := d.propagated[worker]
+		_, isPending := d.pending[worker]
+		if isPropagated || isPending {
+			propagated = append(propagated, d.community)
+			delete(d.propagated, worker)
+			delete(d.pending, worker)
+		}
+	}
+	return propagated
+}
+
+// Subscribed lists the communities that downstream peers are subscribed to,
+// including those still within their grace period.
+func (u *UpstreamSubscriptions) Subscribed() []*fields.QualifiedHash {
+	u.Lock()
+	defer u.Unlock()
+	out := make([]*fields.QualifiedHash, 0, len(u.demand))
+	for _, d := range u.demand {
+		out = append(out, d.community)
+	}
+	return out
+}
+
+// acquire counts one more downstream subscriber to the community. The
+// caller must hold the lock.
+func (u *UpstreamSubscriptions) acquire(community *fields.QualifiedHash) {
+	key := community.String()
+	d, exists := u.demand[key]
+	if !exists {
+		d = &demand{
+			community:  community,
+			propagated: make(map[*sprout.Worker]struct{}),
+			pending:    make(map[*sprout.Worker]struct{}),
+		}
+		u.demand[key] = d
+		for worker := range u.upstreams {
+			u.propagate(d, worker)
+		}
+	}
+	if d.release != nil {
+		d.release.Stop()
+		d.release = nil
+	}
+	d.subscribers++
+}
+
+// release counts one fewer downstream subscriber to the community, starting
+// the grace period if it was the last one. The caller must hold the lock.
+func (u *UpstreamSubscriptions) release(community *fields.QualifiedHash) {
+	key := community.String()
+	d, exists := u.demand[key]
+	if !exists || d.subscribers == 0 {
+		return
+	}
+	d.subscribers--
+	if d.subscribers > 0 {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(u.GracePeriod, func() {
+		u.Lock()
+		defer u.Unlock()
+		if d.release != timer {
+			// a new subscriber arrived during the grace period
+			return
+		}
+		delete(u.demand, key)
+		for worker := range d.propagated {
+			go u.unsubscribe(worker, d.community)
+		}
+	})
+	d.release = timer
+}
+
+// propagate subscribes the given upstream worker to the demanded community
+// unless it is already subscribed (or subscribing). The worker is only
+// recorded as subscribed on behalf of downstream peers once the
+// subscription succeeds. The caller must hold the lock.
+func (u *UpstreamSubscriptions) propagate(d *demand, worker *sprout.Worker) {
+	if _, isPending := d.pending[worker]; isPending || worker.IsLocallySubscribed(d.community) {
+		return
+	}
+	d.pending[worker] = struct{}{}
+	go func() {
+		err := worker.SubscribeToCommunity(d.community, u.FetchLimit)
+		u.Lock()
+		defer u.Unlock()
+		if _, isPending := d.pending[worker]; !isPending {
+			// the worker was removed while subscribing
+			return
+		}
+		delete(d.pending, worker)
+		if err != nil {
+			u.Printf("Failed subscribing upstream to %s: %v", d.community, err)
+			return
+		}
+		// the demand may have ended (and even begun again) while subscribing
+		current, inDemand := u.demand[d.community.String()]
+		if !inDemand {
+			go u.unsubscribe(worker, d.community)
+			return
+		}
+		if _, isPending := current.pending[worker]; !isPending {
+			current.propagated[worker] = struct{}{}
+		}
+	}()
+}
+
+// unsubscribe unsubscribes the upstream worker from the community.
+func (u *UpstreamSubscriptions) unsubscribe(worker *sprout.Worker, community *fields.QualifiedHash) {
+	if err := worker.UnsubscribeFromCommunity(community); err != nil {
+		u.Printf("Failed unsubscribing upstream from %s: %v", community, err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/testkeys"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+var discard = log.New(ioutil.Discard, "", 0)
+
+// testNodes creates an identity and a community authored by it.
+func testNodes(t *testing.T, name string) (*forest.Identity, *forest.Community) {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, name, "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	community, err := forest.As(identity, signer).NewCommunity(name, "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	return identity, community
+}
+
+// newWorker creates a worker on one end of an in-memory connection,
+// returning the other end.
+func newWorker(t *testing.T, store *sprout.SubscriberStore) (*sprout.Worker, net.Conn) {
+	conn, other := net.Pipe()
+	worker, err := sprout.NewWorker(make(chan struct{}), conn, store)
+	if err != nil {
+		t.Fatalf("failed creating worker: %v", err)
+	}
+	worker.Logger = discard
+	worker.DefaultTimeout = 5 * time.Second
+	return worker, other
+}
+
+// newDownstream creates a downstream worker that is never run. Its peer
+// subscriptions are changed directly through its Session.
+func newDownstream(t *testing.T, upstream *UpstreamSubscriptions) *sprout.Worker {
+	worker, _ := newWorker(t, sprout.NewSubscriberStore(forest.NewMemoryStore()))
+	upstream.AddDownstream(worker)
+	return worker
+}
+
+// upstreamPeer is a running worker connected to a running upstream peer
+// whose store holds the given nodes.
+type upstreamPeer struct {
+	relay, peer *sprout.Worker
+	stopped     chan struct{}
+}
+
+func newUpstreamPeer(t *testing.T, nodes ...forest.Node) *upstreamPeer {
+	relay, conn := newWorker(t, sprout.NewSubscriberStore(forest.NewMemoryStore()))
+	peerStore := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	for _, node := range nodes {
+		if err := peerStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	peer, err := sprout.NewWorker(make(chan struct{}), conn, peerStore)
+	if err != nil {
+		t.Fatalf("failed creating worker: %v", err)
+	}
+	peer.Logger = discard
+	u := &upstreamPeer{relay: relay, peer: peer, stopped: make(chan struct{}, 2)}
+	for _, w := range []*sprout.Worker{relay, peer} {
+		go func(w *sprout.Worker) {
+			w.Run()
+			u.stopped <- struct{}{}
+		}(w)
+	}
+	return u
+}
+
+// Stop disconnects the workers and waits for them to exit.
+func (u *upstreamPeer) Stop() {
+	u.relay.Conn.Conn.Close()
+	u.peer.Conn.Conn.Close()
+	<-u.stopped
+	<-u.stopped
+}
+
+// eventually fails the test if the condition does not hold within a few
+// seconds.
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamSubscriptionsRefcount(t *testing.T) {
+	identity, community := testNodes(t, "refcount")
+	upstream := NewUpstreamSubscriptions(20*time.Millisecond, 10, discard)
+	up := newUpstreamPeer(t, identity, community)
+	defer up.Stop()
+	upstream.AddUpstream(up.relay)
+	first, second := newDownstream(t, upstream), newDownstream(t, upstream)
+
+	for _, downstream := range []*sprout.Worker{first, second} {
+		if err := downstream.SubscribePeer(community.ID()); err != nil {
+			t.Fatalf("failed subscribing downstream: %v", err)
+		}
+	}
+	eventually(t, "subscription upstream", func() bool {
+		return up.peer.IsPeerSubscribed(community.ID())
+	})
+	first.UnsubscribePeer(community.ID())
+	// well past the grace period, the remaining subscriber keeps the demand
+	time.Sleep(100 * time.Millisecond)
+	if !up.relay.IsLocallySubscribed(community.ID()) || len(upstream.Subscribed()) != 1 {
+		t.Fatalf("expected to remain subscribed upstream while a downstream peer is subscribed")
+	}
+	second.UnsubscribePeer(community.ID())
+	eventually(t, "unsubscription upstream after the grace period", func() bool {
+		return !up.peer.IsPeerSubscribed(community.ID())
+	})
+	if subscribed := upstream.Subscribed(); len(subscribed) != 0 {
+		t.Fatalf("expected no demand, got %v", subscribed)
+	}
+}
+
+func TestUpstreamSubscriptionsGracePeriod(t *testing.T) {
+	identity, community := testNodes(t, "grace")
+	upstream := NewUpstreamSubscriptions(50*time.Millisecond, 10, discard)
+	up := newUpstreamPeer(t, identity, community)
+	defer up.Stop()
+	upstream.AddUpstream(up.relay)
+	downstream := newDownstream(t, upstream)
+
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	eventually(t, "subscription upstream", func() bool {
+		return up.peer.IsPeerSubscribed(community.ID())
+	})
+	// resubscribing within the grace period cancels it
+	downstream.UnsubscribePeer(community.ID())
+	if len(upstream.Subscribed()) != 1 {
+		t.Fatalf("expected demand to remain during the grace period")
+	}
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !up.peer.IsPeerSubscribed(community.ID()) {
+		t.Fatalf("expected resubscribing within the grace period to keep the upstream subscription")
+	}
+	// the grace period expires once the subscriber leaves for good
+	downstream.UnsubscribePeer(community.ID())
+	eventually(t, "unsubscription upstream after the grace period", func() bool {
+		return !up.peer.IsPeerSubscribed(community.ID())
+	})
+}
+
+func TestUpstreamSubscriptionsIgnoreStaleChanges(t *testing.T) {
+	_, community := testNodes(t, "stale")
+	upstream := NewUpstreamSubscriptions(time.Hour, 10, discard)
+	downstream := newDownstream(t, upstream)
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	// changes reported late or repeatedly must not disturb the count
+	for _, subscribed := range []bool{true, false, true} {
+		downstream.OnSubscriptionChange(sprout.SubscriptionChange{
+			Direction:  sprout.PeerSubscription,
+			Community:  community.ID(),
+			Subscribed: subscribed,
+		})
+	}
+	downstream.UnsubscribePeer(community.ID())
+	// the grace period is long, so the demand remains but is released
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	upstream.RemoveDownstream(downstream)
+	// changes reported after the worker is removed are ignored
+	downstream.UnsubscribePeer(community.ID())
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	other := newDownstream(t, upstream)
+	if err := other.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	other.UnsubscribePeer(community.ID())
+	upstream.Lock()
+	subscribers := upstream.demand[community.ID().String()].subscribers
+	upstream.Unlock()
+	if subscribers != 0 {
+		t.Fatalf("expected every subscriber to be released, %d remain", subscribers)
+	}
+}
+
+func TestUpstreamSubscriptionsAddRemoveUpstream(t *testing.T) {
+	identity, community := testNodes(t, "upstreams")
+	upstream := NewUpstreamSubscriptions(time.Hour, 10, discard)
+	downstream := newDownstream(t, upstream)
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	// an upstream added later is subscribed to the existing demand
+	up := newUpstreamPeer(t, identity, community)
+	defer up.Stop()
+	upstream.AddUpstream(up.relay)
+	eventually(t, "subscription upstream", func() bool {
+		return up.peer.IsPeerSubscribed(community.ID())
+	})
+	eventually(t, "the subscription to be recorded", func() bool {
+		upstream.Lock()
+		defer upstream.Unlock()
+		_, propagated := upstream.demand[community.ID().String()].propagated[up.relay]
+		return propagated
+	})
+	removed := upstream.RemoveUpstream(up.relay)
+	if len(removed) != 1 || !removed[0].Equals(community.ID()) {
+		t.Fatalf("expected the demand-driven subscription to be reported, got %v", removed)
+	}
+	if removed := upstream.RemoveUpstream(up.relay); len(removed) != 0 {
+		t.Fatalf("expected nothing to be reported twice, got %v", removed)
+	}
+}
+
+func TestUpstreamSubscriptionsFailedSubscribe(t *testing.T) {
+	_, community := testNodes(t, "failed")
+	upstream := NewUpstreamSubscriptions(time.Hour, 10, discard)
+	// the upstream worker's peer is gone, so subscribing fails
+	relay, conn := newWorker(t, sprout.NewSubscriberStore(forest.NewMemoryStore()))
+	conn.Close()
+	upstream.AddUpstream(relay)
+	downstream := newDownstream(t, upstream)
+	if err := downstream.SubscribePeer(community.ID()); err != nil {
+		t.Fatalf("failed subscribing downstream: %v", err)
+	}
+	eventually(t, "the subscription to fail", func() bool {
+		upstream.Lock()
+		defer upstream.Unlock()
+		return len(upstream.demand[community.ID().String()].pending) == 0
+	})
+	if removed := upstream.RemoveUpstream(relay); len(removed) != 0 {
+		t.Fatalf("expected a failed subscription not to be recorded, got %v", removed)
+	}
+}
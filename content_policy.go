@@ -0,0 +1,357 @@
+package sprout
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// ErrPolicyViolation is wrapped by every error returned from the built-in
+// ContentPolicy implementations. Custom policies should wrap it as well so
+// that Workers can distinguish policy rejections from validation failures.
+var ErrPolicyViolation = errors.New("content policy violation")
+
+// ContentPolicy decides which nodes a Worker will accept into its store and
+// which it will send to its peer.
+type ContentPolicy interface {
+	// AllowIngest returns a non-nil error explaining why the node must not
+	// be inserted into the store.
+	AllowIngest(node forest.Node) error
+	// AllowServe returns a non-nil error explaining why the node must not be
+	// sent to the peer.
+	AllowServe(node forest.Node) error
+}
+
+// AncestorPolicy may be implemented by a ContentPolicy that judges nodes
+// differently when they are exchanged only as the ancestors of another
+// node. Workers consult it in place of AllowIngest for the ancestors they
+// fetch to validate a node, and in place of AllowServe for the ancestors
+// they send in response to an ancestry request.
+type AncestorPolicy interface {
+	// AllowIngestAncestor returns a non-nil error explaining why the node
+	// must not be inserted into the store as the ancestor of another node.
+	AllowIngestAncestor(node forest.Node) error
+	// AllowServeAncestor returns a non-nil error explaining why the node
+	// must not be sent to the peer as the ancestor of another node.
+	AllowServeAncestor(node forest.Node) error
+}
+
+// allowIngestAncestor consults the given policy about inserting the node as
+// the ancestor of another, using AllowIngest if the policy does not
+// implement AncestorPolicy.
+func allowIngestAncestor(policy ContentPolicy, node forest.Node) error {
+	if ancestors, ok := policy.(AncestorPolicy); ok {
+		return ancestors.AllowIngestAncestor(node)
+	}
+	return policy.AllowIngest(node)
+}
+
+// allowServeAncestor consults the given policy about sending the node as
+// the ancestor of another, using AllowServe if the policy does not
+// implement AncestorPolicy.
+func allowServeAncestor(policy ContentPolicy, node forest.Node) error {
+	if ancestors, ok := policy.(AncestorPolicy); ok {
+		return ancestors.AllowServeAncestor(node)
+	}
+	return policy.AllowServe(node)
+}
+
+// ContentPolicies combines several policies into one that allows a node
+// only if every one of them does. The first rejection is returned.
+func ContentPolicies(policies ...ContentPolicy) ContentPolicy {
+	return contentPolicies(policies)
+}
+
+type contentPolicies []ContentPolicy
+
+func (p contentPolicies) AllowIngest(node forest.Node) error {
+	for _, policy := range p {
+		if err := policy.AllowIngest(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p contentPolicies) AllowServe(node forest.Node) error {
+	for _, policy := range p {
+		if err := policy.AllowServe(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p contentPolicies) AllowIngestAncestor(node forest.Node) error {
+	for _, policy := range p {
+		if err := allowIngestAncestor(policy, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p contentPolicies) AllowServeAncestor(node forest.Node) error {
+	for _, policy := range p {
+		if err := allowServeAncestor(policy, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// idSet is a concurrency-safe set of node IDs.
+type idSet struct {
+	sync.RWMutex
+	ids map[string]struct{}
+}
+
+func newIDSet(ids []*fields.QualifiedHash) *idSet {
+	s := &idSet{
+		ids: make(map[string]struct{}),
+	}
+	for _, id := range ids {
+		s.Add(id)
+	}
+	return s
+}
+
+// Add inserts the given ID into the set.
+func (s *idSet) Add(id *fields.QualifiedHash) {
+	s.Lock()
+	defer s.Unlock()
+	s.ids[id.String()] = struct{}{}
+}
+
+// Remove deletes the given ID from the set.
+func (s *idSet) Remove(id *fields.QualifiedHash) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.ids, id.String())
+}
+
+// Contains returns whether the given ID is in the set.
+func (s *idSet) Contains(id *fields.QualifiedHash) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, has := s.ids[id.String()]
+	return has
+}
+
+// IdentityBlocklist is a ContentPolicy that rejects blocked identities and
+// every node authored by them.
+type IdentityBlocklist struct {
+	*idSet
+}
+
+var _ ContentPolicy = IdentityBlocklist{}
+
+// NewIdentityBlocklist creates a blocklist of the given identity IDs.
+func NewIdentityBlocklist(identityIDs ...*fields.QualifiedHash) IdentityBlocklist {
+	return IdentityBlocklist{newIDSet(identityIDs)}
+}
+
+func (b IdentityBlocklist) check(node forest.Node) error {
+	switch n := node.(type) {
+	case *forest.Identity:
+		if b.Contains(n.ID()) {
+			return fmt.Errorf("%w: identity %s is blocked", ErrPolicyViolation, n.ID())
+		}
+	case *forest.Community:
+		if b.Contains(&n.Author) {
+			return fmt.Errorf("%w: author %s is blocked", ErrPolicyViolation, &n.Author)
+		}
+	case *forest.Reply:
+		if b.Contains(&n.Author) {
+			return fmt.Errorf("%w: author %s is blocked", ErrPolicyViolation, &n.Author)
+		}
+	}
+	return nil
+}
+
+// AllowIngest rejects blocked identities and their nodes.
+func (b IdentityBlocklist) AllowIngest(node forest.Node) error {
+	return b.check(node)
+}
+
+// AllowServe rejects blocked identities and their nodes.
+func (b IdentityBlocklist) AllowServe(node forest.Node) error {
+	return b.check(node)
+}
+
+// CommunityBlocklist is a ContentPolicy that rejects blocked communities and
+// every reply within them.
+type CommunityBlocklist struct {
+	*idSet
+}
+
+var _ ContentPolicy = CommunityBlocklist{}
+
+// NewCommunityBlocklist creates a blocklist of the given community IDs.
+func NewCommunityBlocklist(communityIDs ...*fields.QualifiedHash) CommunityBlocklist {
+	return CommunityBlocklist{newIDSet(communityIDs)}
+}
+
+func (b CommunityBlocklist) check(node forest.Node) error {
+	switch n := node.(type) {
+	case *forest.Community:
+		if b.Contains(n.ID()) {
+			return fmt.Errorf("%w: community %s is blocked", ErrPolicyViolation, n.ID())
+		}
+	case *forest.Reply:
+		if b.Contains(&n.CommunityID) {
+			return fmt.Errorf("%w: community %s is blocked", ErrPolicyViolation, &n.CommunityID)
+		}
+	}
+	return nil
+}
+
+// AllowIngest rejects blocked communities and their replies.
+func (b CommunityBlocklist) AllowIngest(node forest.Node) error {
+	return b.check(node)
+}
+
+// AllowServe rejects blocked communities and their replies.
+func (b CommunityBlocklist) AllowServe(node forest.Node) error {
+	return b.check(node)
+}
+
+// MaxContentSize is a ContentPolicy that rejects nodes whose content or
+// metadata is longer than the given number of bytes.
+type MaxContentSize int
+
+var _ ContentPolicy = MaxContentSize(0)
+
+func (m MaxContentSize) check(node forest.Node) error {
+	var metadata, content *fields.QualifiedContent
+	switch n := node.(type) {
+	case *forest.Identity:
+		metadata = &n.Metadata
+	case *forest.Community:
+		metadata = &n.Metadata
+	case *forest.Reply:
+		metadata, content = &n.Metadata, &n.Content
+	}
+	if content != nil && len(content.Blob) > int(m) {
+		return fmt.Errorf("%w: content is %d bytes, limit is %d", ErrPolicyViolation, len(content.Blob), int(m))
+	}
+	if metadata != nil && len(metadata.Blob) > int(m) {
+		return fmt.Errorf("%w: metadata is %d bytes, limit is %d", ErrPolicyViolation, len(metadata.Blob), int(m))
+	}
+	return nil
+}
+
+// AllowIngest rejects nodes with oversized content.
+func (m MaxContentSize) AllowIngest(node forest.Node) error {
+	return m.check(node)
+}
+
+// AllowServe rejects nodes with oversized content.
+func (m MaxContentSize) AllowServe(node forest.Node) error {
+	return m.check(node)
+}
+
+// MaxTreeDepth is a ContentPolicy that rejects nodes deeper than the given
+// depth in their tree.
+type MaxTreeDepth fields.TreeDepth
+
+var _ ContentPolicy = MaxTreeDepth(0)
+
+func (m MaxTreeDepth) check(node forest.Node) error {
+	if depth := node.TreeDepth(); depth > fields.TreeDepth(m) {
+		return fmt.Errorf("%w: node depth is %d, limit is %d", ErrPolicyViolation, depth, fields.TreeDepth(m))
+	}
+	return nil
+}
+
+// AllowIngest rejects nodes that are too deep.
+func (m MaxTreeDepth) AllowIngest(node forest.Node) error {
+	return m.check(node)
+}
+
+// AllowServe rejects nodes that are too deep.
+func (m MaxTreeDepth) AllowServe(node forest.Node) error {
+	return m.check(node)
+}
+
+// TimestampPolicy is a ContentPolicy that rejects nodes whose creation
+// timestamps are implausible. Nodes dated far in the future would otherwise
+// sort ahead of every other node indefinitely.
+type TimestampPolicy struct {
+	// MaxSkew is how far ahead of the local clock a node's timestamp may be.
+	// Zero disables the check.
+	MaxSkew time.Duration
+	// MaxAge is how far behind the local clock a reply's timestamp may be.
+	// Identities and communities are long-lived and are never rejected for
+	// their age. Ancestors are not rejected for their age either, as a
+	// recent reply cannot be validated or displayed without them. Zero
+	// disables the check.
+	MaxAge time.Duration
+	// FilterServe applies the same checks to nodes sent to the peer, which
+	// keeps nodes stored before the policy was in place from being served.
+	FilterServe bool
+}
+
+var (
+	_ ContentPolicy  = TimestampPolicy{}
+	_ AncestorPolicy = TimestampPolicy{}
+)
+
+// check rejects the node if its timestamp is too far in the future or, if
+// checkAge is set, too far in the past.
+func (p TimestampPolicy) check(node forest.Node, checkAge bool) error {
+	var (
+		created fields.Timestamp
+		isReply bool
+	)
+	switch n := node.(type) {
+	case *forest.Identity:
+		created = n.Created
+	case *forest.Community:
+		created = n.Created
+	case *forest.Reply:
+		created, isReply = n.Created, true
+	default:
+		return nil
+	}
+	now := time.Now()
+	createdAt := created.Time()
+	if p.MaxSkew > 0 && createdAt.After(now.Add(p.MaxSkew)) {
+		return fmt.Errorf("%w: node created %v in the future, limit is %v", ErrPolicyViolation, createdAt.Sub(now).Round(time.Second), p.MaxSkew)
+	}
+	if checkAge && isReply && p.MaxAge > 0 && createdAt.Before(now.Add(-p.MaxAge)) {
+		return fmt.Errorf("%w: node created %v ago, limit is %v", ErrPolicyViolation, now.Sub(createdAt).Round(time.Second), p.MaxAge)
+	}
+	return nil
+}
+
+// AllowIngest rejects nodes with implausible timestamps.
+func (p TimestampPolicy) AllowIngest(node forest.Node) error {
+	return p.check(node, true)
+}
+
+// AllowServe rejects nodes with implausible timestamps if FilterServe is set.
+func (p TimestampPolicy) AllowServe(node forest.Node) error {
+	if !p.FilterServe {
+		return nil
+	}
+	return p.check(node, true)
+}
+
+// AllowIngestAncestor rejects ancestors dated too far in the future.
+func (p TimestampPolicy) AllowIngestAncestor(node forest.Node) error {
+	return p.check(node, false)
+}
+
+// AllowServeAncestor rejects ancestors dated too far in the future if
+// FilterServe is set.
+func (p TimestampPolicy) AllowServeAncestor(node forest.Node) error {
+	if !p.FilterServe {
+		return nil
+	}
+	return p.check(node, false)
+}
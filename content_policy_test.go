@@ -0,0 +1,129 @@
+package sprout_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/testkeys"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func testTree(t *testing.T) (*forest.Identity, *forest.Community, *forest.Reply) {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	builder := forest.As(identity, signer)
+	community, err := builder.NewCommunity(randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	reply, err := builder.NewReply(community, randomString(64), "")
+	if err != nil {
+		t.Fatalf("failed creating reply: %v", err)
+	}
+	return identity, community, reply
+}
+
+func TestContentPolicies(t *testing.T) {
+	identity, community, reply := testTree(t)
+	_, otherCommunity, otherReply := testTree(t)
+	policy := sprout.ContentPolicies(
+		sprout.NewCommunityBlocklist(community.ID()),
+		sprout.MaxContentSize(len(reply.Content.Blob)-1),
+	)
+	for _, node := range []forest.Node{community, reply} {
+		if err := policy.AllowIngest(node); !errors.Is(err, sprout.ErrPolicyViolation) {
+			t.Fatalf("expected policy violation for %T, got %v", node, err)
+		}
+	}
+	if err := policy.AllowServe(otherReply); !errors.Is(err, sprout.ErrPolicyViolation) {
+		t.Fatalf("expected oversized reply to be rejected, got %v", err)
+	}
+	for _, node := range []forest.Node{identity, otherCommunity} {
+		if err := policy.AllowIngest(node); err != nil {
+			t.Fatalf("expected %T to be allowed, got %v", node, err)
+		}
+	}
+}
+
+func TestIdentityBlocklist(t *testing.T) {
+	identity, community, reply := testTree(t)
+	otherIdentity, _, _ := testTree(t)
+	policy := sprout.NewIdentityBlocklist(identity.ID())
+	for _, node := range []forest.Node{identity, community, reply} {
+		if err := policy.AllowServe(node); !errors.Is(err, sprout.ErrPolicyViolation) {
+			t.Fatalf("expected policy violation for %T, got %v", node, err)
+		}
+	}
+	if err := policy.AllowIngest(otherIdentity); err != nil {
+		t.Fatalf("expected other identity to be allowed, got %v", err)
+	}
+	if err := sprout.MaxTreeDepth(0).AllowIngest(reply); !errors.Is(err, sprout.ErrPolicyViolation) {
+		t.Fatalf("expected reply to exceed depth 0, got %v", err)
+	}
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	identity, _, reply := testTree(t)
+	policy := sprout.TimestampPolicy{MaxSkew: time.Minute, MaxAge: time.Hour}
+	if err := policy.AllowIngest(reply); err != nil {
+		t.Fatalf("expected current reply to be allowed, got %v", err)
+	}
+	future := *reply
+	future.Created = fields.TimestampFrom(time.Now().Add(time.Hour))
+	if err := policy.AllowIngest(&future); !errors.Is(err, sprout.ErrPolicyViolation) {
+		t.Fatalf("expected future reply to be rejected, got %v", err)
+	}
+	if err := policy.AllowServe(&future); err != nil {
+		t.Fatalf("expected future reply to be served without FilterServe, got %v", err)
+	}
+	policy.FilterServe = true
+	if err := policy.AllowServe(&future); !errors.Is(err, sprout.ErrPolicyViolation) {
+		t.Fatalf("expected future reply not to be served with FilterServe, got %v", err)
+	}
+	stale := *reply
+	stale.Created = fields.TimestampFrom(time.Now().Add(-2 * time.Hour))
+	if err := policy.AllowIngest(&stale); !errors.Is(err, sprout.ErrPolicyViolation) {
+		t.Fatalf("expected stale reply to be rejected, got %v", err)
+	}
+	oldIdentity := *identity
+	oldIdentity.Created = stale.Created
+	if err := policy.AllowIngest(&oldIdentity); err != nil {
+		t.Fatalf("expected old identity to be allowed, got %v", err)
+	}
+}
+
+func TestTimestampPolicyAncestors(t *testing.T) {
+	_, _, reply := testTree(t)
+	timestamps := sprout.TimestampPolicy{MaxSkew: time.Minute, MaxAge: time.Hour, FilterServe: true}
+	stale := *reply
+	stale.Created = fields.TimestampFrom(time.Now().Add(-2 * time.Hour))
+	future := *reply
+	future.Created = fields.TimestampFrom(time.Now().Add(time.Hour))
+	for _, policy := range []sprout.ContentPolicy{
+		timestamps,
+		sprout.ContentPolicies(sprout.MaxTreeDepth(10), timestamps),
+	} {
+		ancestors, ok := policy.(sprout.AncestorPolicy)
+		if !ok {
+			t.Fatalf("expected %T to implement AncestorPolicy", policy)
+		}
+		if err := ancestors.AllowIngestAncestor(&stale); err != nil {
+			t.Fatalf("expected stale ancestor to be allowed by %T, got %v", policy, err)
+		}
+		if err := ancestors.AllowServeAncestor(&stale); err != nil {
+			t.Fatalf("expected stale ancestor to be served by %T, got %v", policy, err)
+		}
+		if err := ancestors.AllowIngestAncestor(&future); !errors.Is(err, sprout.ErrPolicyViolation) {
+			t.Fatalf("expected future ancestor to be rejected by %T, got %v", policy, err)
+		}
+		if err := policy.AllowServe(&stale); !errors.Is(err, sprout.ErrPolicyViolation) {
+			t.Fatalf("expected stale reply not to be served by %T, got %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package sprout
+
+import (
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// NodeFilter selects the nodes that a filtered subscription is notified
+// about. It returns true for nodes that should be delivered. Filters are
+// evaluated by the store while it has exclusive access, so they must be
+// fast and must not use the store.
+type NodeFilter func(forest.Node) bool
+
+// nodeType returns the type of the given node.
+func nodeType(node forest.Node) (fields.NodeType, bool) {
+	switch node.(type) {
+	case *forest.Identity:
+		return fields.NodeTypeIdentity, true
+	case *forest.Community:
+		return fields.NodeTypeCommunity, true
+	case *forest.Reply:
+		return fields.NodeTypeReply, true
+	default:
+		return 0, false
+	}
+}
+
+// MatchTypes selects nodes of any of the given types.
+func MatchTypes(nodeTypes ...fields.NodeType) NodeFilter {
+	return func(node forest.Node) bool {
+		actual, known := nodeType(node)
+		if !known {
+			return false
+		}
+		for _, nodeType := range nodeTypes {
+			if actual == nodeType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// idMap builds a set of the string forms of the given IDs.
+func idMap(ids []*fields.QualifiedHash) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id.String()] = struct{}{}
+	}
+	return set
+}
+
+// MatchCommunities selects the given communities and the replies within
+// them.
+func MatchCommunities(communityIDs ...*fields.QualifiedHash) NodeFilter {
+	communities := idMap(communityIDs)
+	return func(node forest.Node) bool {
+		var communityID *fields.QualifiedHash
+		switch n := node.(type) {
+		case *forest.Community:
+			communityID = n.ID()
+		case *forest.Reply:
+			communityID = &n.CommunityID
+		default:
+			return false
+		}
+		_, match := communities[communityID.String()]
+		return match
+	}
+}
+
+// MatchAuthors selects the given identities and the nodes that they
+// authored.
+func MatchAuthors(identityIDs ...*fields.QualifiedHash) NodeFilter {
+	identities := idMap(identityIDs)
+	return func(node forest.Node) bool {
+		var authorID *fields.QualifiedHash
+		switch n := node.(type) {
+		case *forest.Identity:
+			authorID = n.ID()
+		case *forest.Community:
+			authorID = &n.Author
+		case *forest.Reply:
+			authorID = &n.Author
+		default:
+			return false
+		}
+		_, match := identities[authorID.String()]
+		return match
+	}
+}
+
+// MatchAll selects nodes selected by every one of the given filters.
+func MatchAll(filters ...NodeFilter) NodeFilter {
+	return func(node forest.Node) bool {
+		for _, filter := range filters {
+			if !filter(node) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAny selects nodes selected by at least one of the given filters.
+func MatchAny(filters ...NodeFilter) NodeFilter {
+	return func(node forest.Node) bool {
+		for _, filter := range filters {
+			if filter(node) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package sprout
+
+import "sync"
+
+// InflightGroup deduplicates concurrent operations that share a key. While
+// an operation is running, other callers requesting the same key wait for
+// it to finish and receive its result instead of repeating it.
+//
+// Each Worker creates its own InflightGroup, but Workers that share a store
+// can be given the same InflightGroup so that they also deduplicate work
+// between one another.
+type InflightGroup struct {
+	sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done chan struct{}
+	err  error
+}
+
+// NewInflightGroup creates an empty InflightGroup.
+func NewInflightGroup() *InflightGroup {
+	return &InflightGroup{
+		calls: make(map[string]*inflightCall),
+	}
+}
+
+// Do runs fn unless an operation with the same key is already running, in
+// which case it waits for that operation and returns its error instead.
+func (g *InflightGroup) Do(key string, fn func() error) error {
+	g.Lock()
+	if call, running := g.calls[key]; running {
+		g.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		delete(g.calls, key)
+		g.Unlock()
+		close(call.done)
+	}()
+	call.err = fn()
+	return call.err
+}
@@ -0,0 +1,100 @@
+package sprout
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+const (
+	// defaultKnownNodeCapacity is the number of node IDs that each Worker
+	// remembers its peer having.
+	defaultKnownNodeCapacity = 16384
+	// defaultKnownNodeLifetime is how long each Worker remembers that its
+	// peer has a particular node.
+	defaultKnownNodeLifetime = 10 * time.Minute
+)
+
+type knownEntry struct {
+	id         string
+	expiration time.Time
+}
+
+// knownNodes is a bounded set of node IDs in which elements expire after a
+// fixed lifetime. When the set is full, the least recently added element is
+// evicted to make room.
+type knownNodes struct {
+	sync.Mutex
+	capacity int
+	lifetime time.Duration
+	// order holds *knownEntry values, least recently added first
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newKnownNodes(capacity int, lifetime time.Duration) *knownNodes {
+	return &knownNodes{
+		capacity: capacity,
+		lifetime: lifetime,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Add records the given node IDs, refreshing the lifetime of any that are
+// already present.
+func (k *knownNodes) Add(ids ...*fields.QualifiedHash) {
+	k.Lock()
+	defer k.Unlock()
+	expiration := time.Now().Add(k.lifetime)
+	for _, id := range ids {
+		key := id.String()
+		if element, has := k.entries[key]; has {
+			element.Value.(*knownEntry).expiration = expiration
+			k.order.MoveToBack(element)
+			continue
+		}
+		k.entries[key] = k.order.PushBack(&knownEntry{id: key, expiration: expiration})
+		for k.order.Len() > k.capacity {
+			k.remove(k.order.Front())
+		}
+	}
+}
+
+// Has returns whether the given node ID is present and unexpired.
+func (k *knownNodes) Has(id *fields.QualifiedHash) bool {
+	k.Lock()
+	defer k.Unlock()
+	k.purge()
+	_, has := k.entries[id.String()]
+	return has
+}
+
+// Len returns the number of unexpired IDs in the set.
+func (k *knownNodes) Len() int {
+	k.Lock()
+	defer k.Unlock()
+	k.purge()
+	return k.order.Len()
+}
+
+// purge removes expired elements. Since every addition receives the same
+// lifetime, expired elements are always at the front of the order. The
+// caller must hold the lock.
+func (k *knownNodes) purge() {
+	now := time.Now()
+	for element := k.order.Front(); element != nil; element = k.order.Front() {
+		if element.Value.(*knownEntry).expiration.After(now) {
+			return
+		}
+		k.remove(element)
+	}
+}
+
+// remove deletes the given element. The caller must hold the lock.
+func (k *knownNodes) remove(element *list.Element) {
+	delete(k.entries, element.Value.(*knownEntry).id)
+	k.order.Remove(element)
+}
@@ -0,0 +1,161 @@
+package sprout
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// ErrOrphaned is wrapped by the error returned from IngestNode when a node
+// could not be validated yet and is being held until the nodes that it
+// references arrive.
+var ErrOrphaned = errors.New("node held until referenced nodes arrive")
+
+// defaultMaxOrphans is the number of orphaned nodes each Worker will hold.
+const defaultMaxOrphans = 4096
+
+type orphan struct {
+	key        string
+	node       forest.Node
+	missing    []string
+	expiration time.Time
+	// index is the orphan's position in the pool's expiration queue
+	index int
+}
+
+// orphanQueue is a heap of orphans ordered by expiration, soonest first.
+type orphanQueue []*orphan
+
+func (q orphanQueue) Len() int {
+	return len(q)
+}
+
+func (q orphanQueue) Less(i, j int) bool {
+	return q[i].expiration.Before(q[j].expiration)
+}
+
+func (q orphanQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *orphanQueue) Push(x interface{}) {
+	record := x.(*orphan)
+	record.index = len(*q)
+	*q = append(*q, record)
+}
+
+func (q *orphanQueue) Pop() interface{} {
+	old := *q
+	record := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return record
+}
+
+// orphanPool holds nodes that reference nodes which are not yet available,
+// indexed by the IDs of those missing nodes.
+type orphanPool struct {
+	sync.Mutex
+	capacity int
+	// orphans maps the ID of each orphan to its record
+	orphans map[string]*orphan
+	// waiting maps the ID of each missing node to the set of IDs of the
+	// orphans that reference it
+	waiting map[string]map[string]struct{}
+	// expirations holds the orphans in order of expiration, so that
+	// expired orphans can be found without scanning the whole pool
+	expirations orphanQueue
+}
+
+func newOrphanPool(capacity int) *orphanPool {
+	return &orphanPool{
+		capacity: capacity,
+		orphans:  make(map[string]*orphan),
+		waiting:  make(map[string]map[string]struct{}),
+	}
+}
+
+// Add holds the given node until one of the missing nodes arrives or the
+// expiration passes. It returns false if the pool is full.
+func (p *orphanPool) Add(node forest.Node, missing []*fields.QualifiedHash, expiration time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+	p.purge()
+	key := node.ID().String()
+	if existing, has := p.orphans[key]; has {
+		p.remove(key, existing)
+	} else if len(p.orphans) >= p.capacity {
+		return false
+	}
+	record := &orphan{
+		key:        key,
+		node:       node,
+		missing:    make([]string, len(missing)),
+		expiration: expiration,
+	}
+	for i, id := range missing {
+		missingKey := id.String()
+		record.missing[i] = missingKey
+		if p.waiting[missingKey] == nil {
+			p.waiting[missingKey] = make(map[string]struct{})
+		}
+		p.waiting[missingKey][key] = struct{}{}
+	}
+	p.orphans[key] = record
+	heap.Push(&p.expirations, record)
+	return true
+}
+
+// Resolve removes and returns every orphan that was waiting for the node
+// with the given ID.
+func (p *orphanPool) Resolve(id *fields.QualifiedHash) []forest.Node {
+	p.Lock()
+	defer p.Unlock()
+	p.purge()
+	waiting := p.waiting[id.String()]
+	if len(waiting) == 0 {
+		return nil
+	}
+	resolved := make([]forest.Node, 0, len(waiting))
+	for orphanKey := range waiting {
+		record := p.orphans[orphanKey]
+		p.remove(orphanKey, record)
+		resolved = append(resolved, record.node)
+	}
+	return resolved
+}
+
+// Len returns the number of unexpired orphans in the pool.
+func (p *orphanPool) Len() int {
+	p.Lock()
+	defer p.Unlock()
+	p.purge()
+	return len(p.orphans)
+}
+
+// purge removes expired orphans. The caller must hold the lock.
+func (p *orphanPool) purge() {
+	now := time.Now()
+	for len(p.expirations) > 0 && p.expirations[0].expiration.Before(now) {
+		record := p.expirations[0]
+		p.remove(record.key, record)
+	}
+}
+
+// remove deletes the orphan with the given key. The caller must hold the lock.
+func (p *orphanPool) remove(key string, record *orphan) {
+	delete(p.orphans, key)
+	heap.Remove(&p.expirations, record.index)
+	for _, missingKey := range record.missing {
+		delete(p.waiting[missingKey], key)
+		if len(p.waiting[missingKey]) == 0 {
+			delete(p.waiting, missingKey)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package sprout
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// ProvenanceSource describes how a Worker came to receive a node.
+type ProvenanceSource int
+
+const (
+	// ViaAnnounce nodes were announced by the peer.
+	ViaAnnounce ProvenanceSource = iota
+	// ViaAncestry nodes were fetched as the ancestors of another node.
+	ViaAncestry
+	// ViaQuery nodes were queried from the peer by ID, such as the authors
+	// of other nodes.
+	ViaQuery
+	// ViaBootstrap nodes were fetched while loading the history of a
+	// community.
+	ViaBootstrap
+)
+
+func (s ProvenanceSource) String() string {
+	switch s {
+	case ViaAnnounce:
+		return "announce"
+	case ViaAncestry:
+		return "ancestry"
+	case ViaQuery:
+		return "query"
+	case ViaBootstrap:
+		return "bootstrap"
+	default:
+		return "unknown"
+	}
+}
+
+// Provenance records where a node in the store came from.
+type Provenance struct {
+	// Peer identifies the peer that sent the node (see Worker.PeerAddress).
+	Peer string
+	// Time is when the node was inserted into the store.
+	Time time.Time
+	Via  ProvenanceSource
+}
+
+// PeerContribution summarizes the nodes that one peer has contributed to
+// the store.
+type PeerContribution struct {
+	// Nodes is the total number of nodes contributed.
+	Nodes uint64
+	// Via counts the contributed nodes by how they were received.
+	Via map[ProvenanceSource]uint64
+	// Latest is when the most recent node was contributed.
+	Latest time.Time
+}
+
+// defaultProvenanceCapacity is the number of nodes whose provenance a new
+// ProvenanceIndex remembers.
+const defaultProvenanceCapacity = 65536
+
+// defaultProvenancePeers is the number of peers whose contributions a new
+// ProvenanceIndex remembers.
+const defaultProvenancePeers = 1024
+
+// provenanceEntry is the provenance of one node.
+type provenanceEntry struct {
+	id string
+	Provenance
+}
+
+// contributionEntry is the contribution of one peer.
+type contributionEntry struct {
+	peer string
+	*PeerContribution
+}
+
+// ProvenanceIndex records the provenance of the nodes that Workers insert
+// into their store. Only the first insertion of each node is recorded.
+//
+// The provenance of at most MaxNodes nodes is remembered. Once the index is
+// full, the provenance of the least recently recorded node is forgotten to
+// make room, after which that node may be recorded (and counted in the
+// contributions of its peer) again. Likewise, the contributions of at most
+// MaxPeers peers are remembered, and the peer that contributed least
+// recently is forgotten to make room for a new one.
+//
+// Workers sharing a store should share a ProvenanceIndex so that it covers
+// every peer.
+type ProvenanceIndex struct {
+	sync.RWMutex
+	// MaxNodes is the number of nodes whose provenance is remembered. Zero
+	// means no limit.
+	MaxNodes int
+	// MaxPeers is the number of peers whose contributions are remembered.
+	// Zero means no limit.
+	MaxPeers int
+	// order holds *provenanceEntry values, least recently recorded first
+	order *list.List
+	nodes map[string]*list.Element
+	// peerOrder holds *contributionEntry values, least recent contributor
+	// first
+	peerOrder *list.List
+	peers     map[string]*list.Element
+}
+
+// NewProvenanceIndex creates an empty ProvenanceIndex remembering the
+// provenance of a default number of nodes and the contributions of a
+// default number of peers.
+func NewProvenanceIndex() *ProvenanceIndex {
+	return &ProvenanceIndex{
+		MaxNodes:  defaultProvenanceCapacity,
+		MaxPeers:  defaultProvenancePeers,
+		order:     list.New(),
+		nodes:     make(map[string]*list.Element),
+		peerOrder: list.New(),
+		peers:     make(map[string]*list.Element),
+	}
+}
+
+// Record notes the provenance of the node with the given ID. It returns
+// false without changing anything if the node's provenance was already
+// recorded.
+func (p *ProvenanceIndex) Record(id *fields.QualifiedHash, provenance Provenance) bool {
+	key := id.String()
+	p.Lock()
+	defer p.Unlock()
+	if _, has := p.nodes[key]; has {
+		return false
+	}
+	p.nodes[key] = p.order.PushBack(&provenanceEntry{id: key, Provenance: provenance})
+	for p.MaxNodes > 0 && p.order.Len() > p.MaxNodes {
+		oldest := p.order.Front()
+		delete(p.nodes, oldest.Value.(*provenanceEntry).id)
+		p.order.Remove(oldest)
+	}
+	element, has := p.peers[provenance.Peer]
+	if has {
+		p.peerOrder.MoveToBack(element)
+	} else {
+		element = p.peerOrder.PushBack(&contributionEntry{
+			peer: provenance.Peer,
+			PeerContribution: &PeerContribution{
+				Via: make(map[ProvenanceSource]uint64),
+			},
+		})
+		p.peers[provenance.Peer] = element
+		for p.MaxPeers > 0 && p.peerOrder.Len() > p.MaxPeers {
+			oldest := p.peerOrder.Front()
+			delete(p.peers, oldest.Value.(*contributionEntry).peer)
+			p.peerOrder.Remove(oldest)
+		}
+	}
+	contribution := element.Value.(*contributionEntry).PeerContribution
+	contribution.Nodes++
+	contribution.Via[provenance.Via]++
+	if provenance.Time.After(contribution.Latest) {
+		contribution.Latest = provenance.Time
+	}
+	return true
+}
+
+// Lookup returns the provenance of the node with the given ID, if known.
+func (p *ProvenanceIndex) Lookup(id *fields.QualifiedHash) (Provenance, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	element, has := p.nodes[id.String()]
+	if !has {
+		return Provenance{}, false
+	}
+	return element.Value.(*provenanceEntry).Provenance, true
+}
+
+// Peers returns the contribution of each peer, keyed by peer address.
+func (p *ProvenanceIndex) Peers() map[string]PeerContribution {
+	p.RLock()
+	defer p.RUnlock()
+	peers := make(map[string]PeerContribution, len(p.peers))
+	for peer, element := range p.peers {
+		contribution := element.Value.(*contributionEntry).PeerContribution
+		copied := *contribution
+		copied.Via = make(map[ProvenanceSource]uint64, len(contribution.Via))
+		for via, count := range contribution.Via {
+			copied.Via[via] = count
+		}
+		peers[peer] = copied
+	}
+	return peers
+}
+
+// Len returns the number of nodes whose provenance is recorded.
+func (p *ProvenanceIndex) Len() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.nodes)
+}
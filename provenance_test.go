@@ -0,0 +1,86 @@
+package sprout_test
+
+import (
+	"testing"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestProvenanceIndex(t *testing.T) {
+	identity, community, reply := testTree(t)
+	index := sprout.NewProvenanceIndex()
+	now := time.Now()
+	if !index.Record(identity.ID(), sprout.Provenance{Peer: "a", Time: now, Via: sprout.ViaQuery}) {
+		t.Fatalf("expected first record of identity to succeed")
+	}
+	if index.Record(identity.ID(), sprout.Provenance{Peer: "b", Time: now, Via: sprout.ViaAnnounce}) {
+		t.Fatalf("expected second record of identity to be ignored")
+	}
+	index.Record(community.ID(), sprout.Provenance{Peer: "a", Time: now, Via: sprout.ViaBootstrap})
+	index.Record(reply.ID(), sprout.Provenance{Peer: "b", Time: now, Via: sprout.ViaAnnounce})
+
+	if provenance, has := index.Lookup(identity.ID()); !has || provenance.Peer != "a" || provenance.Via != sprout.ViaQuery {
+		t.Fatalf("expected identity to come from peer a via query, got %+v", provenance)
+	}
+	peers := index.Peers()
+	if peers["a"].Nodes != 2 || peers["a"].Via[sprout.ViaBootstrap] != 1 {
+		t.Fatalf("unexpected contribution from peer a: %+v", peers["a"])
+	}
+	if peers["b"].Nodes != 1 || peers["b"].Via[sprout.ViaAnnounce] != 1 {
+		t.Fatalf("unexpected contribution from peer b: %+v", peers["b"])
+	}
+}
+
+func TestProvenanceIndexLimit(t *testing.T) {
+	identity, community, reply := testTree(t)
+	index := sprout.NewProvenanceIndex()
+	index.MaxNodes = 2
+	now := time.Now()
+	for _, id := range []*fields.QualifiedHash{identity.ID(), community.ID(), reply.ID()} {
+		index.Record(id, sprout.Provenance{Peer: "a", Time: now, Via: sprout.ViaAnnounce})
+	}
+	if index.Len() != 2 {
+		t.Fatalf("expected 2 recorded nodes, got %d", index.Len())
+	}
+	if _, has := index.Lookup(identity.ID()); has {
+		t.Fatalf("expected the least recently recorded node to be forgotten")
+	}
+	if _, has := index.Lookup(reply.ID()); !has {
+		t.Fatalf("expected the most recently recorded node to be remembered")
+	}
+	if !index.Record(identity.ID(), sprout.Provenance{Peer: "b", Time: now, Via: sprout.ViaQuery}) {
+		t.Fatalf("expected a forgotten node to be recorded again")
+	}
+	if peers := index.Peers(); peers["a"].Nodes != 3 || peers["b"].Nodes != 1 {
+		t.Fatalf("expected contributions to survive eviction, got %+v", peers)
+	}
+}
+
+func TestProvenanceIndexPeerLimit(t *testing.T) {
+	identity, community, reply := testTree(t)
+	_, otherCommunity, _ := testTree(t)
+	index := sprout.NewProvenanceIndex()
+	index.MaxPeers = 2
+	now := time.Now()
+	index.Record(identity.ID(), sprout.Provenance{Peer: "a", Time: now, Via: sprout.ViaQuery})
+	index.Record(community.ID(), sprout.Provenance{Peer: "b", Time: now, Via: sprout.ViaAnnounce})
+	// peer a contributes again, so b becomes the least recent contributor
+	index.Record(reply.ID(), sprout.Provenance{Peer: "a", Time: now, Via: sprout.ViaAnnounce})
+	index.Record(otherCommunity.ID(), sprout.Provenance{Peer: "c", Time: now, Via: sprout.ViaAnnounce})
+	peers := index.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 peers, got %+v", peers)
+	}
+	if _, has := peers["b"]; has {
+		t.Fatalf("expected the least recent contributor to be forgotten")
+	}
+	if peers["a"].Nodes != 2 || peers["c"].Nodes != 1 {
+		t.Fatalf("unexpected contributions: %+v", peers)
+	}
+	// the provenance of nodes is kept when their peer is forgotten
+	if provenance, has := index.Lookup(community.ID()); !has || provenance.Peer != "b" {
+		t.Fatalf("expected the provenance of peer b's node to remain, got %+v", provenance)
+	}
+}
@@ -0,0 +1,314 @@
+package sprout
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// QuarantineRecord describes a node that was rejected by a Worker.
+type QuarantineRecord struct {
+	Node forest.Node
+	// Reason is the text of the error that caused the rejection.
+	Reason string
+	// Peer identifies the peer that sent the node (see Worker.PeerAddress).
+	Peer string
+	// Time is when the node was rejected.
+	Time time.Time
+}
+
+// quarantineFile is the on-disk representation of a QuarantineRecord.
+type quarantineFile struct {
+	Node   []byte    `json:"node"`
+	Reason string    `json:"reason"`
+	Peer   string    `json:"peer"`
+	Time   time.Time `json:"time"`
+}
+
+const quarantineFileSuffix = ".json"
+
+// Quarantine holds nodes that were rejected during ingestion along with the
+// reason they were rejected, so that they can be inspected and retried
+// later. It is kept separate from the store of valid nodes.
+//
+// A Quarantine created with a directory keeps one file per node in that
+// directory, so records survive restarts and can be managed by another
+// process (such as the relay's command line flags). Otherwise records are
+// only held in memory.
+//
+// So that a peer sending invalid nodes cannot exhaust the disk or memory,
+// the number of records can be limited. When a limit is reached, the oldest
+// record within it is evicted to make room for the new one.
+type Quarantine struct {
+	sync.RWMutex
+	// MaxRecords limits the total number of records. Zero means no limit.
+	MaxRecords int
+	// MaxRecordsPerPeer limits the number of records from any one peer.
+	// Zero means no limit.
+	MaxRecordsPerPeer int
+	dir               string
+	records           map[string]*quarantineEntry
+	// order holds every record, oldest first
+	order *list.List
+	// peers holds the records from each peer, oldest first
+	peers map[string]*list.List
+}
+
+// quarantineEntry locates a record in the Quarantine's orderings.
+type quarantineEntry struct {
+	record *QuarantineRecord
+	// element is the record's position in the Quarantine's order, and
+	// peerElement its position among the records from the same peer
+	element, peerElement *list.Element
+}
+
+// NewQuarantine creates a Quarantine persisted in the given directory,
+// loading any records already there. If dir is empty, the Quarantine is
+// held only in memory.
+func NewQuarantine(dir string) (*Quarantine, error) {
+	q := &Quarantine{
+		dir:     dir,
+		records: make(map[string]*quarantineEntry),
+		order:   list.New(),
+		peers:   make(map[string]*list.List),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, fmt.Errorf("failed creating quarantine directory %s: %w", dir, err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing quarantine directory %s: %w", dir, err)
+	}
+	records := make([]*QuarantineRecord, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), quarantineFileSuffix) {
+			continue
+		}
+		record, err := readQuarantineFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	for _, record := range records {
+		q.insert(record)
+	}
+	return q, nil
+}
+
+func readQuarantineFile(path string) (*QuarantineRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading quarantine record %s: %w", path, err)
+	}
+	var file quarantineFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed decoding quarantine record %s: %w", path, err)
+	}
+	node, err := forest.UnmarshalBinaryNode(file.Node)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding node in quarantine record %s: %w", path, err)
+	}
+	return &QuarantineRecord{
+		Node:   node,
+		Reason: file.Reason,
+		Peer:   file.Peer,
+		Time:   file.Time,
+	}, nil
+}
+
+// path returns the file in which the record for the given ID is stored.
+func (q *Quarantine) path(id string) string {
+	return filepath.Join(q.dir, id+quarantineFileSuffix)
+}
+
+// Add quarantines the given node, replacing any existing record for it. If
+// this would exceed MaxRecords or MaxRecordsPerPeer, the oldest record
+// (from the same peer, for MaxRecordsPerPeer) is removed first.
+func (q *Quarantine) Add(node forest.Node, reason error, peer string) error {
+	record := &QuarantineRecord{
+		Node:   node,
+		Reason: reason.Error(),
+		Peer:   peer,
+		Time:   time.Now(),
+	}
+	id := node.ID().String()
+	q.Lock()
+	defer q.Unlock()
+	if err := q.remove(id); err != nil {
+		return err
+	}
+	if fromPeer, has := q.peers[peer]; has && q.MaxRecordsPerPeer > 0 && fromPeer.Len() >= q.MaxRecordsPerPeer {
+		if err := q.evictOldest(fromPeer); err != nil {
+			return err
+		}
+	}
+	if q.MaxRecords > 0 && len(q.records) >= q.MaxRecords {
+		if err := q.evictOldest(q.order); err != nil {
+			return err
+		}
+	}
+	if q.dir != "" {
+		nodeData, err := node.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("failed serializing quarantined node %s: %w", id, err)
+		}
+		data, err := json.Marshal(quarantineFile{
+			Node:   nodeData,
+			Reason: record.Reason,
+			Peer:   record.Peer,
+			Time:   record.Time,
+		})
+		if err != nil {
+			return fmt.Errorf("failed encoding quarantine record for %s: %w", id, err)
+		}
+		if err := ioutil.WriteFile(q.path(id), data, 0660); err != nil {
+			return fmt.Errorf("failed writing quarantine record for %s: %w", id, err)
+		}
+	}
+	q.insert(record)
+	return nil
+}
+
+// insert adds the given record, which must be newer than every other, to
+// the Quarantine's records. The caller must hold the lock.
+func (q *Quarantine) insert(record *QuarantineRecord) {
+	fromPeer, has := q.peers[record.Peer]
+	if !has {
+		fromPeer = list.New()
+		q.peers[record.Peer] = fromPeer
+	}
+	q.records[record.Node.ID().String()] = &quarantineEntry{
+		record:      record,
+		element:     q.order.PushBack(record),
+		peerElement: fromPeer.PushBack(record),
+	}
+}
+
+// evictOldest removes the oldest record in the given list, which must be
+// the Quarantine's order or one of its peers' lists. The caller must hold
+// the lock.
+func (q *Quarantine) evictOldest(records *list.List) error {
+	oldest := records.Front()
+	if oldest == nil {
+		return nil
+	}
+	return q.remove(oldest.Value.(*QuarantineRecord).Node.ID().String())
+}
+
+// Get returns the record for the node with the given ID, if it is
+// quarantined.
+func (q *Quarantine) Get(id *fields.QualifiedHash) (QuarantineRecord, bool) {
+	q.RLock()
+	defer q.RUnlock()
+	entry, has := q.records[id.String()]
+	if !has {
+		return QuarantineRecord{}, false
+	}
+	return *entry.record, true
+}
+
+// List returns every quarantined record, oldest first.
+func (q *Quarantine) List() []QuarantineRecord {
+	q.RLock()
+	defer q.RUnlock()
+	records := make([]QuarantineRecord, 0, len(q.records))
+	for element := q.order.Front(); element != nil; element = element.Next() {
+		records = append(records, *element.Value.(*QuarantineRecord))
+	}
+	return records
+}
+
+// Len returns the number of quarantined nodes.
+func (q *Quarantine) Len() int {
+	q.RLock()
+	defer q.RUnlock()
+	return len(q.records)
+}
+
+// Remove deletes the record for the node with the given ID. It does nothing
+// if the node is not quarantined.
+func (q *Quarantine) Remove(id *fields.QualifiedHash) error {
+	q.Lock()
+	defer q.Unlock()
+	return q.remove(id.String())
+}
+
+// remove deletes the record with the given key. The caller must hold the lock.
+func (q *Quarantine) remove(id string) error {
+	entry, has := q.records[id]
+	if !has {
+		return nil
+	}
+	if q.dir != "" {
+		if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed removing quarantine record for %s: %w", id, err)
+		}
+	}
+	delete(q.records, id)
+	q.order.Remove(entry.element)
+	fromPeer := q.peers[entry.record.Peer]
+	fromPeer.Remove(entry.peerElement)
+	if fromPeer.Len() == 0 {
+		delete(q.peers, entry.record.Peer)
+	}
+	return nil
+}
+
+// Purge deletes every record of a node quarantined before the given time
+// and returns the number of records deleted. Pass time.Now() to purge
+// everything.
+func (q *Quarantine) Purge(before time.Time) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	purged := 0
+	for element := q.order.Front(); element != nil; {
+		record := element.Value.(*QuarantineRecord)
+		element = element.Next()
+		if !record.Time.Before(before) {
+			continue
+		}
+		if err := q.remove(record.Node.ID().String()); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Retry validates the quarantined node with the given ID against the given
+// store again and, if it is now valid, inserts it into the store and
+// removes it from quarantine. Content policies are not consulted, as
+// retrying a node is an explicit decision to accept it.
+func (q *Quarantine) Retry(id *fields.QualifiedHash, store forest.Store) error {
+	record, has := q.Get(id)
+	if !has {
+		return fmt.Errorf("node %s is not quarantined", id)
+	}
+	if err := VerifyNode(record.Node, store); err != nil {
+		return fmt.Errorf("node %s is still invalid: %w", id, err)
+	}
+	if err := record.Node.ValidateDeep(store); err != nil {
+		return fmt.Errorf("node %s is still invalid: %w", id, err)
+	}
+	if err := store.Add(record.Node); err != nil {
+		return fmt.Errorf("failed adding node %s to store: %w", id, err)
+	}
+	return q.Remove(id)
+}
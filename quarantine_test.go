@@ -0,0 +1,143 @@
+package sprout_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestQuarantinePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	_, community, reply := testTree(t)
+	q, err := sprout.NewQuarantine(dir)
+	if err != nil {
+		t.Fatalf("failed creating quarantine: %v", err)
+	}
+	if err := q.Add(reply, errors.New("bad reply"), "peer:1"); err != nil {
+		t.Fatalf("failed quarantining reply: %v", err)
+	}
+	if err := q.Add(community, errors.New("bad community"), "peer:2"); err != nil {
+		t.Fatalf("failed quarantining community: %v", err)
+	}
+
+	reopened, err := sprout.NewQuarantine(dir)
+	if err != nil {
+		t.Fatalf("failed reopening quarantine: %v", err)
+	}
+	record, has := reopened.Get(reply.ID())
+	if !has {
+		t.Fatalf("expected reply to be quarantined after reopening")
+	}
+	if !record.Node.Equals(reply) || record.Reason != "bad reply" || record.Peer != "peer:1" {
+		t.Fatalf("quarantine record did not survive reopening: %+v", record)
+	}
+	if records := reopened.List(); len(records) != 2 || !records[0].Node.Equals(reply) {
+		t.Fatalf("expected 2 records oldest first, got %d", len(records))
+	}
+	if purged, err := reopened.Purge(time.Now()); err != nil || purged != 2 {
+		t.Fatalf("expected to purge 2 records, purged %d: %v", purged, err)
+	}
+	if reopened, err = sprout.NewQuarantine(dir); err != nil {
+		t.Fatalf("failed reopening quarantine: %v", err)
+	} else if reopened.Len() != 0 {
+		t.Fatalf("expected purged quarantine to be empty, has %d records", reopened.Len())
+	}
+}
+
+func TestQuarantineRetry(t *testing.T) {
+	identity, community, _ := testTree(t)
+	q, err := sprout.NewQuarantine("")
+	if err != nil {
+		t.Fatalf("failed creating quarantine: %v", err)
+	}
+	if err := q.Add(community, errors.New("missing author"), "peer"); err != nil {
+		t.Fatalf("failed quarantining community: %v", err)
+	}
+	store := forest.NewMemoryStore()
+	if err := q.Retry(community.ID(), store); err == nil {
+		t.Fatalf("expected retry without author to fail")
+	}
+	if err := store.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	if err := q.Retry(community.ID(), store); err != nil {
+		t.Fatalf("expected retry with author to succeed: %v", err)
+	}
+	if _, has, _ := store.Get(community.ID()); !has {
+		t.Fatalf("expected retried community to be in store")
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected retried community to leave quarantine")
+	}
+}
+
+func TestQuarantineLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quarantine")
+	if err != nil {
+		t.Fatalf("failed creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	identity, community, reply := testTree(t)
+	otherIdentity, otherCommunity, _ := testTree(t)
+	q, err := sprout.NewQuarantine(dir)
+	if err != nil {
+		t.Fatalf("failed creating quarantine: %v", err)
+	}
+	q.MaxRecords = 3
+	q.MaxRecordsPerPeer = 2
+	for _, add := range []struct {
+		node forest.Node
+		peer string
+	}{
+		{identity, "a"},
+		{community, "a"},
+		// evicts identity, the oldest record from peer a
+		{reply, "a"},
+		{otherIdentity, "b"},
+		// evicts community, the oldest record overall
+		{otherCommunity, "b"},
+	} {
+		if err := q.Add(add.node, errors.New("rejected"), add.peer); err != nil {
+			t.Fatalf("failed quarantining node: %v", err)
+		}
+	}
+	for _, evicted := range []forest.Node{identity, community} {
+		if _, has := q.Get(evicted.ID()); has {
+			t.Errorf("expected %T to be evicted", evicted)
+		}
+	}
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 records, got %d", q.Len())
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 3 {
+		t.Fatalf("expected evicted records to be removed from disk, found %d: %v", len(entries), err)
+	}
+
+	// records loaded from disk are evicted in the order they were added
+	reopened, err := sprout.NewQuarantine(dir)
+	if err != nil {
+		t.Fatalf("failed reopening quarantine: %v", err)
+	}
+	reopened.MaxRecordsPerPeer = 1
+	if err := reopened.Add(community, errors.New("rejected"), "b"); err != nil {
+		t.Fatalf("failed quarantining node: %v", err)
+	}
+	if _, has := reopened.Get(otherIdentity.ID()); has {
+		t.Fatalf("expected the oldest record from peer b to be evicted")
+	}
+	if _, has := reopened.Get(otherCommunity.ID()); !has {
+		t.Fatalf("expected only the oldest record from peer b to be evicted")
+	}
+	if records := reopened.List(); len(records) != 3 || !records[0].Node.Equals(reply) || !records[2].Node.Equals(community) {
+		t.Fatalf("expected records oldest first, got %d", len(records))
+	}
+}
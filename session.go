@@ -1,51 +1,197 @@
 package sprout
 
 import (
+	"errors"
 	"sync"
 
 	"git.sr.ht/~whereswaldon/forest-go/fields"
 )
 
+// ErrTooManySubscriptions is returned when a peer attempts to subscribe to
+// more communities than its Session permits.
+var ErrTooManySubscriptions = errors.New("too many subscriptions")
+
+// SubscriptionDirection identifies one of the two subscription sets within
+// a Session.
+type SubscriptionDirection int
+
+const (
+	// PeerSubscription refers to communities that the peer asked us to
+	// announce new nodes for (by sending us a subscribe message).
+	PeerSubscription SubscriptionDirection = iota
+	// LocalSubscription refers to communities that we asked the peer to
+	// announce new nodes for.
+	LocalSubscription
+)
+
+// SubscriptionChange describes a single change to a Session's subscriptions.
+type SubscriptionChange struct {
+	Direction SubscriptionDirection
+	Community *fields.QualifiedHash
+	// Subscribed is true if the community was added and false if it was
+	// removed.
+	Subscribed bool
+}
+
 // Session stores the state of a sprout connection between hosts,
-// which is currently just the subscribed community set.
+// which is currently the set of communities subscribed in each direction.
+// Communities are keyed by the string form of their ID, so each community
+// is present at most once in each direction.
 type Session struct {
 	sync.RWMutex
-	Communities map[*fields.QualifiedHash]struct{}
+	// MaxPeerSubscriptions limits the number of communities that the peer
+	// may subscribe to. Zero means no limit.
+	MaxPeerSubscriptions int
+	// OnSubscriptionChange, if set, is invoked after each change to the
+	// subscription sets. It is invoked without holding the Session's lock,
+	// so it may call methods on the Session.
+	OnSubscriptionChange func(SubscriptionChange)
+
+	peerCommunities  map[string]*fields.QualifiedHash
+	localCommunities map[string]*fields.QualifiedHash
 }
 
 func NewSession() *Session {
 	return &Session{
-		Communities: make(map[*fields.QualifiedHash]struct{}),
+		peerCommunities:  make(map[string]*fields.QualifiedHash),
+		localCommunities: make(map[string]*fields.QualifiedHash),
 	}
 }
 
-func (c *Session) Subscribe(communityID *fields.QualifiedHash) {
-	c.Lock()
-	defer c.Unlock()
+// SubscribePeer records that the peer subscribed to the given community.
+// It returns ErrTooManySubscriptions if that would exceed MaxPeerSubscriptions.
+func (c *Session) SubscribePeer(communityID *fields.QualifiedHash) error {
+	return c.subscribe(PeerSubscription, communityID)
+}
+
+// IsPeerSubscribed returns whether the peer is subscribed to the given community.
+func (c *Session) IsPeerSubscribed(communityID *fields.QualifiedHash) bool {
+	return c.IsSubscribed(PeerSubscription, communityID)
+}
+
+// UnsubscribePeer records that the peer unsubscribed from the given community.
+func (c *Session) UnsubscribePeer(communityID *fields.QualifiedHash) {
+	c.unsubscribe(PeerSubscription, communityID)
+}
+
+// PeerSubscriptions lists the communities that the peer is subscribed to.
+func (c *Session) PeerSubscriptions() []*fields.QualifiedHash {
+	return c.List(PeerSubscription)
+}
 
-	c.Communities[communityID] = struct{}{}
+// SubscribeLocal records that we subscribed to the given community on the peer.
+func (c *Session) SubscribeLocal(communityID *fields.QualifiedHash) {
+	// local subscriptions are not limited, so this cannot fail
+	_ = c.subscribe(LocalSubscription, communityID)
 }
 
-func (c *Session) IsSubscribed(communityID *fields.QualifiedHash) bool {
+// IsLocallySubscribed returns whether we are subscribed to the given community
+// on the peer.
+func (c *Session) IsLocallySubscribed(communityID *fields.QualifiedHash) bool {
+	return c.IsSubscribed(LocalSubscription, communityID)
+}
+
+// UnsubscribeLocal records that we unsubscribed from the given community on
+// the peer.
+func (c *Session) UnsubscribeLocal(communityID *fields.QualifiedHash) {
+	c.unsubscribe(LocalSubscription, communityID)
+}
+
+// LocalSubscriptions lists the communities that we are subscribed to on the peer.
+func (c *Session) LocalSubscriptions() []*fields.QualifiedHash {
+	return c.List(LocalSubscription)
+}
+
+// IsSubscribed returns whether the given community is in the subscription
+// set for the given direction.
+func (c *Session) IsSubscribed(direction SubscriptionDirection, communityID *fields.QualifiedHash) bool {
 	c.RLock()
 	defer c.RUnlock()
 
-	for community := range c.Communities {
-		if community.Equals(communityID) {
-			return true
+	_, subscribed := c.communities(direction)[communityID.String()]
+	return subscribed
+}
+
+// List returns a snapshot of the subscription set for the given direction.
+// The returned slice is not affected by later changes to the Session.
+func (c *Session) List(direction SubscriptionDirection) []*fields.QualifiedHash {
+	c.RLock()
+	defer c.RUnlock()
+
+	communities := c.communities(direction)
+	out := make([]*fields.QualifiedHash, 0, len(communities))
+	for _, community := range communities {
+		out = append(out, community)
+	}
+	return out
+}
+
+// Count returns the number of communities in the subscription set for the
+// given direction.
+func (c *Session) Count(direction SubscriptionDirection) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.communities(direction))
+}
+
+// communities returns the map for the given direction. The caller must hold
+// the Session's lock.
+func (c *Session) communities(direction SubscriptionDirection) map[string]*fields.QualifiedHash {
+	if direction == LocalSubscription {
+		return c.localCommunities
+	}
+	return c.peerCommunities
+}
+
+func (c *Session) subscribe(direction SubscriptionDirection, communityID *fields.QualifiedHash) error {
+	key := communityID.String()
+	added, err := func() (bool, error) {
+		c.Lock()
+		defer c.Unlock()
+
+		communities := c.communities(direction)
+		if _, subscribed := communities[key]; subscribed {
+			return false, nil
+		}
+		if direction == PeerSubscription && c.MaxPeerSubscriptions > 0 && len(communities) >= c.MaxPeerSubscriptions {
+			return false, ErrTooManySubscriptions
 		}
+		communities[key] = &fields.QualifiedHash{
+			Descriptor: communityID.Descriptor,
+			Blob:       communityID.Blob,
+		}
+		return true, nil
+	}()
+	if added {
+		c.notify(SubscriptionChange{Direction: direction, Community: communityID, Subscribed: true})
 	}
-	return false
+	return err
 }
 
-func (c *Session) Unsubscribe(communityID *fields.QualifiedHash) {
-	c.Lock()
-	defer c.Unlock()
+func (c *Session) unsubscribe(direction SubscriptionDirection, communityID *fields.QualifiedHash) {
+	key := communityID.String()
+	removed := func() bool {
+		c.Lock()
+		defer c.Unlock()
 
-	for community := range c.Communities {
-		if community.Equals(communityID) {
-			delete(c.Communities, community)
-			return
+		communities := c.communities(direction)
+		if _, subscribed := communities[key]; !subscribed {
+			return false
 		}
+		delete(communities, key)
+		return true
+	}()
+	if removed {
+		c.notify(SubscriptionChange{Direction: direction, Community: communityID, Subscribed: false})
+	}
+}
+
+func (c *Session) notify(change SubscriptionChange) {
+	c.RLock()
+	handler := c.OnSubscriptionChange
+	c.RUnlock()
+	if handler != nil {
+		handler(change)
 	}
 }
@@ -0,0 +1,84 @@
+package sprout_test
+
+import (
+	"testing"
+
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func copyHash(id *fields.QualifiedHash) *fields.QualifiedHash {
+	return &fields.QualifiedHash{
+		Descriptor: id.Descriptor,
+		Blob:       append(fields.Blob{}, id.Blob...),
+	}
+}
+
+func TestSessionSubscribeByValue(t *testing.T) {
+	session := sprout.NewSession()
+	id := randomQualifiedHash()
+	if err := session.SubscribePeer(id); err != nil {
+		t.Fatalf("failed subscribing: %v", err)
+	}
+	if err := session.SubscribePeer(copyHash(id)); err != nil {
+		t.Fatalf("failed subscribing with equal id: %v", err)
+	}
+	if count := session.Count(sprout.PeerSubscription); count != 1 {
+		t.Fatalf("expected 1 peer subscription, got %d", count)
+	}
+	if !session.IsPeerSubscribed(copyHash(id)) {
+		t.Fatalf("expected equal id to be subscribed")
+	}
+	if session.IsLocallySubscribed(id) {
+		t.Fatalf("peer subscription should not be visible as a local subscription")
+	}
+	session.UnsubscribePeer(copyHash(id))
+	if session.IsPeerSubscribed(id) {
+		t.Fatalf("expected id to be unsubscribed")
+	}
+}
+
+func TestSessionSubscriptionLimit(t *testing.T) {
+	session := sprout.NewSession()
+	session.MaxPeerSubscriptions = 2
+	ids := randomQualifiedHashSlice(3)
+	for _, id := range ids[:2] {
+		if err := session.SubscribePeer(id); err != nil {
+			t.Fatalf("failed subscribing within limit: %v", err)
+		}
+	}
+	if err := session.SubscribePeer(ids[2]); err != sprout.ErrTooManySubscriptions {
+		t.Fatalf("expected ErrTooManySubscriptions, got %v", err)
+	}
+	if err := session.SubscribePeer(ids[0]); err != nil {
+		t.Fatalf("resubscribing to existing community should not hit the limit: %v", err)
+	}
+	for _, id := range ids {
+		session.SubscribeLocal(id)
+	}
+	if count := len(session.LocalSubscriptions()); count != len(ids) {
+		t.Fatalf("local subscriptions should not be limited, expected %d got %d", len(ids), count)
+	}
+}
+
+func TestSessionSubscriptionChanges(t *testing.T) {
+	session := sprout.NewSession()
+	changes := []sprout.SubscriptionChange{}
+	session.OnSubscriptionChange = func(change sprout.SubscriptionChange) {
+		changes = append(changes, change)
+	}
+	id := randomQualifiedHash()
+	session.SubscribeLocal(id)
+	session.SubscribeLocal(id)
+	session.UnsubscribeLocal(id)
+	session.UnsubscribeLocal(id)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(changes))
+	}
+	if !changes[0].Subscribed || changes[0].Direction != sprout.LocalSubscription || !changes[0].Community.Equals(id) {
+		t.Fatalf("unexpected first change: %+v", changes[0])
+	}
+	if changes[1].Subscribed {
+		t.Fatalf("expected second change to be an unsubscribe")
+	}
+}
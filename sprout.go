@@ -3,6 +3,7 @@ package sprout
 import (
 	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -400,6 +401,9 @@ const (
 	ErrorProtocolTooOld StatusCode = 2
 	ErrorProtocolTooNew StatusCode = 3
 	ErrorUnknownNode    StatusCode = 4
+	// ErrorRejected reports that the recipient refused some of the nodes
+	// in an announce message, such as because of its content policy.
+	ErrorRejected StatusCode = 5
 )
 
 // String converts the status code into a human-readable error message
@@ -416,6 +420,8 @@ func (s StatusCode) String() string {
 		description = "protocol too new"
 	case ErrorUnknownNode:
 		description = "referenced unknown node"
+	case ErrorRejected:
+		description = "nodes rejected"
 	}
 	return fmt.Sprintf("status code %d (%s)", s, description)
 }
@@ -453,6 +459,46 @@ func (s *Conn) SendAnnounce(nodes []forest.Node, timeoutChan <-chan time.Time) e
 	return s.handleExpectedStatus(op, responseChan, messageID, err, timeoutChan)
 }
 
+// SendAnnounceAndVerify announces the existence of the given nodes to the peer
+// on the other end of the sprout connection and then queries the peer for
+// those nodes to learn which of them it accepted. Nodes that the peer did not
+// store (whether because they were invalid or because the peer isn't
+// interested in them) are returned as rejected.
+//
+// This is most useful with peers that finish ingesting announced nodes before
+// replying, such as a Worker with SynchronousAnnounce enabled. A non-OK status
+// in response to the announce is not returned as an error, since the query
+// reports which nodes caused it. The timeoutChan is used for both messages,
+// so a time.Ticker is recommended.
+func (s *Conn) SendAnnounceAndVerify(nodes []forest.Node, timeoutChan <-chan time.Time) (accepted, rejected []forest.Node, err error) {
+	if err := s.SendAnnounce(nodes, timeoutChan); err != nil {
+		var status Status
+		if !errors.As(err, &status) {
+			return nil, nil, err
+		}
+	}
+	ids := make([]*fields.QualifiedHash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID()
+	}
+	response, err := s.SendQuery(ids, timeoutChan)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed verifying announced nodes: %w", err)
+	}
+	stored := make(map[string]struct{}, len(response.Nodes))
+	for _, node := range response.Nodes {
+		stored[node.ID().String()] = struct{}{}
+	}
+	for _, node := range nodes {
+		if _, ok := stored[node.ID().String()]; ok {
+			accepted = append(accepted, node)
+		} else {
+			rejected = append(rejected, node)
+		}
+	}
+	return accepted, rejected, nil
+}
+
 // scanOp scans the fields for the given verb from the input connection and into
 // the provided fields slice.
 func (s *Conn) scanOp(verb Verb, fields ...interface{}) error {
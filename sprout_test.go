@@ -551,3 +551,27 @@ func TestWithRealNetConn(t *testing.T) {
 		t.Fatalf("Handler wasn't invoked within 1 second")
 	}
 }
+
+func TestAnnounceAndVerifyMessage(t *testing.T) {
+	const count = 4
+	_, inNodes := randomNodeSlice(count, t)
+	conn := &LoopbackConn{}
+	sconn, err := sprout.NewConn(conn)
+	if err != nil {
+		t.Fatalf("failed to construct sprout.Conn: %v", err)
+	}
+	sconn.OnAnnounce = func(s *sprout.Conn, m sprout.MessageID, nodes []forest.Node) error {
+		return s.SendStatus(m, sprout.ErrorMalformed)
+	}
+	sconn.OnQuery = func(s *sprout.Conn, m sprout.MessageID, nodeIDs []*fields.QualifiedHash) error {
+		// pretend that only the first half of the nodes were accepted
+		return s.SendResponse(m, inNodes[:count/2])
+	}
+	go readConnOrFail(sconn, 4, t)
+	accepted, rejected, err := sconn.SendAnnounceAndVerify(inNodes, time.NewTicker(time.Second).C)
+	if err != nil {
+		t.Fatalf("failed to send announce: %v", err)
+	}
+	verifyResponse(inNodes[:count/2], sprout.Response{Nodes: accepted}, t)
+	verifyResponse(inNodes[count/2:], sprout.Response{Nodes: rejected}, t)
+}
@@ -0,0 +1,171 @@
+package sprout
+
+import (
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+)
+
+// defaultSubscriberQueueSize is the number of notifications that may wait
+// for each subscriber of a SubscriberStore unless configured otherwise.
+const defaultSubscriberQueueSize = 1024
+
+// OverflowPolicy determines what happens to a notification for a subscriber
+// whose queue is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the notification that did not fit in the queue.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest notification waiting in the queue to
+	// make room for the new one.
+	DropOldest
+)
+
+// SubscriberStats describes the notification queue of one subscriber. Each
+// notification carries the nodes from one Add, AddAs, AddAll or AddAllAs.
+type SubscriberStats struct {
+	Subscription Subscription
+	// Queued is the number of notifications waiting to be delivered.
+	Queued int
+	// Delivered is the number of notifications the handler has processed.
+	Delivered uint64
+	// Dropped is the number of notifications discarded because the queue
+	// was full.
+	Dropped uint64
+	// Busy is how long the handler has been processing its current
+	// notification, or zero if it is idle.
+	Busy time.Duration
+}
+
+// subscriber delivers notifications to one handler on its own goroutine.
+type subscriber struct {
+	// the counters are accessed atomically and must stay 64-bit aligned
+	delivered, dropped uint64
+	// busySince is the UnixNano time at which the handler began processing
+	// its current notification, or zero
+	busySince int64
+	// overflowing is set to one when the queue overflows and reset once
+	// the queue drains
+	overflowing int32
+
+	id      Subscription
+	created time.Time
+	handler func([]forest.Node)
+	// filter, if set, selects the nodes that are queued for the handler
+	filter NodeFilter
+	queue  chan []forest.Node
+	stop   chan struct{}
+	// done is closed when run returns
+	done chan struct{}
+}
+
+func newSubscriber(id Subscription, handler func([]forest.Node), queueSize int) *subscriber {
+	if queueSize < 1 {
+		queueSize = defaultSubscriberQueueSize
+	}
+	s := &subscriber{
+		id:      id,
+		created: time.Now(),
+		handler: handler,
+		queue:   make(chan []forest.Node, queueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// run delivers queued notifications until the subscriber is stopped or its
+// queue is closed and empty.
+func (s *subscriber) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		select {
+		case <-s.stop:
+			return
+		case nodes, open := <-s.queue:
+			if !open {
+				return
+			}
+			atomic.StoreInt64(&s.busySince, time.Now().UnixNano())
+			s.handler(nodes)
+			atomic.StoreInt64(&s.busySince, 0)
+			atomic.AddUint64(&s.delivered, 1)
+			if len(s.queue) == 0 {
+				atomic.StoreInt32(&s.overflowing, 0)
+			}
+		}
+	}
+}
+
+// enqueue queues the nodes selected by the subscriber's filter for delivery
+// without blocking, applying the overflow policy if the queue is full. It
+// returns true if this caused the queue to begin overflowing.
+func (s *subscriber) enqueue(nodes []forest.Node, policy OverflowPolicy) (startedOverflowing bool) {
+	if s.filter != nil {
+		matching := make([]forest.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if s.filter(node) {
+				matching = append(matching, node)
+			}
+		}
+		nodes = matching
+	}
+	if len(nodes) == 0 {
+		return false
+	}
+	select {
+	case s.queue <- nodes:
+		return false
+	default:
+	}
+	if policy == DropOldest {
+		select {
+		case <-s.queue:
+		default:
+		}
+		select {
+		case s.queue <- nodes:
+		default:
+		}
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return atomic.CompareAndSwapInt32(&s.overflowing, 0, 1)
+}
+
+// Stop ends delivery. Notifications still in the queue are discarded.
+func (s *subscriber) Stop() {
+	close(s.stop)
+}
+
+// Finish ends delivery once the notifications already in the queue have
+// been delivered. Nothing may be enqueued afterward.
+func (s *subscriber) Finish() {
+	close(s.queue)
+}
+
+// Wait blocks until the subscriber's goroutine has exited.
+func (s *subscriber) Wait() {
+	<-s.done
+}
+
+// Stats reports the current state of the subscriber's queue.
+func (s *subscriber) Stats() SubscriberStats {
+	stats := SubscriberStats{
+		Subscription: s.id,
+		Queued:       len(s.queue),
+		Delivered:    atomic.LoadUint64(&s.delivered),
+		Dropped:      atomic.LoadUint64(&s.dropped),
+	}
+	if since := atomic.LoadInt64(&s.busySince); since != 0 {
+		stats.Busy = time.Since(time.Unix(0, since))
+	}
+	return stats
+}
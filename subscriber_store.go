@@ -1,6 +1,14 @@
 package sprout
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
 	"git.sr.ht/~whereswaldon/forest-go"
 	"git.sr.ht/~whereswaldon/forest-go/fields"
 )
@@ -8,7 +16,11 @@ import (
 // Subscription is an identifier for a particular handler function within
 // a SubscriberStore. It can be provided to delete a handler function or to
 // suppress notifications to the corresponding handler.
-type Subscription uint
+//
+// Pre-add and post-add subscriptions share a single sequence of IDs, and a
+// store never issues the same ID twice, so a stale ID can never refer to
+// another handler.
+type Subscription uint64
 
 // the zero subscription is never used
 const neverAssigned = 0
@@ -17,30 +29,75 @@ const firstSubscription = 1
 // SubscriberStore is a wrapper type that extends the forest.Store interface
 // with the observer pattern. Code can subscribe for updates each time a
 // node is inserted into the store using Add or AddAs.
+//
+// Any number of reads from the store may run concurrently, so the
+// underlying store must support concurrent reads (as both forest's
+// MemoryStore and grove do). Add and AddAs have exclusive access to the
+// store while they run the pre-add handlers, insert the node and queue
+// notifications for the post-add handlers, so no read can be interleaved
+// with those steps.
+//
+// Each post-add subscriber receives notifications in the order in which
+// nodes were added, through a bounded queue drained by its own goroutine.
+// The exported fields configure those queues and must be set before the
+// store is used.
 type SubscriberStore struct {
-	store                                 forest.Store
-	requests                              chan func()
-	nextSubscriberKey                     Subscription
-	postAddSubscribers, preAddSubscribers map[Subscription]func(forest.Node)
+	// QueueSize is the number of notifications that may wait for each
+	// post-add subscriber. It applies to subscriptions created after it is
+	// set.
+	QueueSize int
+	// Overflow determines which notification is discarded when a
+	// subscriber's queue is full.
+	Overflow OverflowPolicy
+	// OnSlowSubscriber, if set, is invoked on a new goroutine whenever a
+	// subscriber's queue overflows after having been drained.
+	OnSlowSubscriber func(SubscriberStats)
+
+	store forest.Store
+	// lock is held for reading by reads from the store and for writing by
+	// insertions and changes to the subscriber maps
+	lock              sync.RWMutex
+	nextSubscriberKey Subscription
+	changes           ChangeLog
+	sequence          Sequence
+	closed            bool
+	// closing is closed when the store is closed
+	closing            chan struct{}
+	postAddSubscribers map[Subscription]*subscriber
+	preAddSubscribers  map[Subscription]presubscriber
+}
+
+// presubscriber is a handler invoked before nodes are inserted.
+type presubscriber struct {
+	handler func(forest.Node)
+	filter  NodeFilter
+	created time.Time
 }
 
 var _ forest.Store = &SubscriberStore{}
 
 // NewMessageStore creates a thread-safe storage structure for
-// forest nodes by wrapping an existing store implementation
+// forest nodes by wrapping an existing store implementation. The store
+// remembers a limited number of recent changes in memory; use
+// NewSubscriberStoreWithChangeLog to configure this.
 func NewSubscriberStore(store forest.Store) *SubscriberStore {
+	return NewSubscriberStoreWithChangeLog(store, NewMemoryChangeLog(defaultChangeLogCapacity))
+}
+
+// NewSubscriberStoreWithChangeLog wraps the given store like
+// NewSubscriberStore, recording each change in the given change log.
+// Sequence numbers continue from the last change already in the log.
+func NewSubscriberStoreWithChangeLog(store forest.Store, changes ChangeLog) *SubscriberStore {
 	m := &SubscriberStore{
+		QueueSize:          defaultSubscriberQueueSize,
 		store:              store,
-		requests:           make(chan func()),
 		nextSubscriberKey:  firstSubscription,
-		postAddSubscribers: make(map[Subscription]func(forest.Node)),
-		preAddSubscribers:  make(map[Subscription]func(forest.Node)),
+		postAddSubscribers: make(map[Subscription]*subscriber),
+		preAddSubscribers:  make(map[Subscription]presubscriber),
+		changes:            changes,
+		sequence:           changes.Last(),
+		closing:            make(chan struct{}),
 	}
-	go func() {
-		for function := range m.requests {
-			function()
-		}
-	}()
 	return m
 }
 
@@ -49,11 +106,167 @@ func NewSubscriberStore(store forest.Store) *SubscriberStore {
 // can be used to unsubscribe later, as well as to supress notifications
 // with AddAs().
 //
-// Handler functions are invoked synchronously on the same goroutine that invokes
-// Add() or AddAs(), and should not block. If long-running code is needed in a
-// handler, launch a new goroutine.
+// Handler functions are invoked on a goroutine dedicated to the subscription,
+// one node at a time in the order the nodes were added, and may use the store.
+// Notifications wait in a queue of QueueSize notifications while the handler
+// is busy, and are discarded according to the Overflow policy if the queue
+// fills up.
 func (m *SubscriberStore) SubscribeToNewMessages(handler func(n forest.Node)) (subscriptionID Subscription) {
-	return m.subscribeInMap(m.postAddSubscribers, handler)
+	return m.SubscribeToMatchingMessages(nil, handler)
+}
+
+// SubscribeToMatchingMessages is like SubscribeToNewMessages, but the handler
+// is only notified of the nodes selected by the given filter. The filter is
+// evaluated before nodes are queued, so nodes that it rejects do not occupy
+// the subscription's queue. A nil filter selects every node.
+func (m *SubscriberStore) SubscribeToMatchingMessages(filter NodeFilter, handler func(n forest.Node)) (subscriptionID Subscription) {
+	return m.SubscribeToBatches(filter, eachNode(handler))
+}
+
+// SubscribeToBatches is like SubscribeToMatchingMessages, but the handler
+// receives every node inserted by a single call to AddAll or AddAllAs (that
+// matches the filter) at once, in the order they were inserted.
+func (m *SubscriberStore) SubscribeToBatches(filter NodeFilter, handler func(nodes []forest.Node)) (subscriptionID Subscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.subscribe(filter, handler, nil)
+}
+
+// subscribe creates a post-add subscriber, optionally queueing a first
+// notification for it. If the store is closed, the handler will never be
+// invoked. The caller must hold the lock.
+func (m *SubscriberStore) subscribe(filter NodeFilter, handler func([]forest.Node), replay []forest.Node) Subscription {
+	subscriptionID := m.nextSubscription()
+	if m.closed {
+		return subscriptionID
+	}
+	queueSize := m.QueueSize
+	if queueSize < 1 {
+		queueSize = defaultSubscriberQueueSize
+	}
+	sub := newSubscriber(subscriptionID, handler, queueSize)
+	sub.filter = filter
+	sub.enqueue(replay, m.Overflow)
+	m.postAddSubscribers[subscriptionID] = sub
+	return subscriptionID
+}
+
+// eachNode adapts a handler for single nodes to receive notifications of
+// several nodes.
+func eachNode(handler func(forest.Node)) func([]forest.Node) {
+	return func(nodes []forest.Node) {
+		for _, node := range nodes {
+			handler(node)
+		}
+	}
+}
+
+// SubscribeFromSequence is like SubscribeToMatchingMessages, but the handler
+// is first notified of every change after the given sequence number that
+// matches the filter (as reported by ChangesSince), followed without gaps or
+// duplicates by the nodes added afterward.
+//
+// The bulk of the history is read from the ChangeLog without holding
+// exclusive access to the store, so that insertions are not blocked while
+// a long history is replayed from disk. Exclusive access is only needed to
+// read the changes made in the meantime and register the subscription.
+func (m *SubscriberStore) SubscribeFromSequence(since Sequence, filter NodeFilter, handler func(n forest.Node)) (Subscription, error) {
+	m.lock.RLock()
+	closed, snapshot := m.closed, m.sequence
+	m.lock.RUnlock()
+	if closed {
+		return neverAssigned, ErrStoreClosed
+	}
+	missed, err := m.changes.Since(since)
+	// changes appended after the snapshot are read again below
+	for len(missed) > 0 && missed[len(missed)-1].Sequence > snapshot {
+		missed = missed[:len(missed)-1]
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return neverAssigned, ErrStoreClosed
+	} else if err != nil {
+		return neverAssigned, fmt.Errorf("failed replaying changes since %d: %w", since, err)
+	}
+	if m.sequence > snapshot {
+		// since may be newer than the snapshot if the caller learned of
+		// changes made after it was taken
+		if snapshot < since {
+			snapshot = since
+		}
+		rest, err := m.changes.Since(snapshot)
+		if err != nil {
+			return neverAssigned, fmt.Errorf("failed replaying changes since %d: %w", snapshot, err)
+		}
+		missed = append(missed, rest...)
+	}
+	replay := make([]forest.Node, len(missed))
+	for i, change := range missed {
+		replay[i] = change.Node
+	}
+	return m.subscribe(filter, eachNode(handler), replay), nil
+}
+
+// Sequence returns the sequence number of the most recent change to the
+// store.
+func (m *SubscriberStore) Sequence() Sequence {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.sequence
+}
+
+// ChangesSince returns every change to the store after the one with the
+// given sequence number, in order. Pass zero for every change in the store's
+// ChangeLog. If the log no longer holds some of the requested changes, the
+// returned error wraps ErrChangesUnavailable.
+func (m *SubscriberStore) ChangesSince(since Sequence) ([]Change, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrStoreClosed
+	}
+	return m.changes.Since(since)
+}
+
+// Watch returns a channel on which the nodes selected by the given filter
+// (or all nodes, if filter is nil) are delivered as they are added to the
+// store. The subscription ends and the channel is closed when the context
+// is done or the store is closed. Nodes wait in the subscription's queue while the receiver is
+// busy, exactly as they would for a handler registered with
+// SubscribeToMatchingMessages.
+func (m *SubscriberStore) Watch(ctx context.Context, filter NodeFilter) <-chan forest.Node {
+	var (
+		out    = make(chan forest.Node)
+		lock   sync.Mutex
+		closed bool
+	)
+	subscriptionID := m.SubscribeToMatchingMessages(filter, func(node forest.Node) {
+		lock.Lock()
+		defer lock.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case out <- node:
+		case <-ctx.Done():
+		case <-m.closing:
+		}
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-m.closing:
+		}
+		m.UnsubscribeToNewMessages(subscriptionID)
+		// wait for any delivery in progress to give up before closing
+		lock.Lock()
+		defer lock.Unlock()
+		closed = true
+		close(out)
+	}()
+	return out
 }
 
 // PresubscribeToNewMessages establishes the given function as a handler to be
@@ -63,177 +276,414 @@ func (m *SubscriberStore) SubscribeToNewMessages(handler func(n forest.Node)) (s
 // inserted into the store instead of after (like a normal Subscribe).
 //
 // Handler functions are invoked synchronously on the same goroutine that invokes
-// Add() or AddAs(), and should not block. If long-running code is needed in a
-// handler, launch a new goroutine.
+// Add() or AddAs() while it holds exclusive access to the store, and should not
+// block or use the store. If long-running code is needed in a handler, launch a
+// new goroutine.
 func (m *SubscriberStore) PresubscribeToNewMessages(handler func(n forest.Node)) (subscriptionID Subscription) {
-	return m.subscribeInMap(m.preAddSubscribers, handler)
-}
-
-func (m *SubscriberStore) subscribeInMap(targetMap map[Subscription]func(forest.Node), handler func(n forest.Node)) (subscriptionID Subscription) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		subscriptionID = m.nextSubscriberKey
-		m.nextSubscriberKey++
-		// handler unsigned overflow
-		// TODO: ensure subscription reuse can't occur
-		if m.nextSubscriberKey == neverAssigned {
-			m.nextSubscriberKey = firstSubscription
-		}
-		targetMap[subscriptionID] = handler
+	return m.PresubscribeToMatchingMessages(nil, handler)
+}
+
+// PresubscribeToMatchingMessages is like PresubscribeToNewMessages, but the
+// handler is only invoked for the nodes selected by the given filter. A nil
+// filter selects every node.
+func (m *SubscriberStore) PresubscribeToMatchingMessages(filter NodeFilter, handler func(n forest.Node)) (subscriptionID Subscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	subscriptionID = m.nextSubscription()
+	if m.closed {
+		// the handler could never be invoked
+		return
 	}
-	<-done
+	m.preAddSubscribers[subscriptionID] = presubscriber{
+		handler: handler,
+		filter:  filter,
+		created: time.Now(),
+	}
+	return
+}
+
+// nextSubscription allocates a subscription ID. The caller must hold the lock.
+func (m *SubscriberStore) nextSubscription() (subscriptionID Subscription) {
+	// at a million subscriptions per second, 64 bits last for over half a
+	// million years, so the IDs are never reused
+	subscriptionID = m.nextSubscriberKey
+	m.nextSubscriberKey++
 	return
 }
 
 // UnsubscribeToNewMessages removes the handler for a given subscription from
-// the store.
+// the store. Notifications still waiting in the subscription's queue are
+// discarded, though a handler invocation that is already running will
+// complete.
 func (m *SubscriberStore) UnsubscribeToNewMessages(subscriptionID Subscription) {
-	m.unsubscribeInMap(m.postAddSubscribers, subscriptionID)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if sub, subscribed := m.postAddSubscribers[subscriptionID]; subscribed {
+		sub.Stop()
+		delete(m.postAddSubscribers, subscriptionID)
+	}
+}
+
+// FinishSubscription removes the post-add subscription with the given ID
+// once the notifications already queued for it have been delivered, and
+// returns after they have been. The handler must not be waiting for
+// exclusive access to the store.
+func (m *SubscriberStore) FinishSubscription(subscriptionID Subscription) {
+	m.lock.Lock()
+	sub, subscribed := m.postAddSubscribers[subscriptionID]
+	if subscribed {
+		sub.Finish()
+		delete(m.postAddSubscribers, subscriptionID)
+	}
+	m.lock.Unlock()
+	if subscribed {
+		sub.Wait()
+	}
 }
 
 // UnpresubscribeToNewMessages removes the handler for a given subscription from
 // the store.
 func (m *SubscriberStore) UnpresubscribeToNewMessages(subscriptionID Subscription) {
-	m.unsubscribeInMap(m.preAddSubscribers, subscriptionID)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.preAddSubscribers, subscriptionID)
 }
 
-func (m *SubscriberStore) unsubscribeInMap(targetMap map[Subscription]func(forest.Node), subscriptionID Subscription) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		if _, subscribed := targetMap[subscriptionID]; subscribed {
-			delete(targetMap, subscriptionID)
-		}
+// Unsubscribe removes the subscription with the given ID, whether it is a
+// pre-add or a post-add subscription. It does nothing if the subscription
+// does not exist.
+func (m *SubscriberStore) Unsubscribe(subscriptionID Subscription) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if sub, subscribed := m.postAddSubscribers[subscriptionID]; subscribed {
+		sub.Stop()
+		delete(m.postAddSubscribers, subscriptionID)
 	}
-	<-done
-	return
+	delete(m.preAddSubscribers, subscriptionID)
+}
+
+// SubscriptionKind distinguishes handlers invoked before nodes are inserted
+// from those notified afterward.
+type SubscriptionKind int
+
+const (
+	PostAddSubscription SubscriptionKind = iota
+	PreAddSubscription
+)
+
+func (k SubscriptionKind) String() string {
+	switch k {
+	case PostAddSubscription:
+		return "post-add"
+	case PreAddSubscription:
+		return "pre-add"
+	default:
+		return "unknown"
+	}
+}
+
+// SubscriptionInfo describes an active subscription, for debugging.
+type SubscriptionInfo struct {
+	ID      Subscription
+	Kind    SubscriptionKind
+	Created time.Time
+	// Filtered is true if the subscription only receives some nodes.
+	Filtered bool
+	// Queue describes the notification queue of post-add subscriptions. It
+	// is nil for pre-add subscriptions, which have no queue.
+	Queue *SubscriberStats
+}
+
+// ActiveSubscriptions describes every subscription to the store, ordered by
+// ID (and therefore by creation).
+func (m *SubscriberStore) ActiveSubscriptions() []SubscriptionInfo {
+	m.lock.RLock()
+	active := make([]SubscriptionInfo, 0, len(m.postAddSubscribers)+len(m.preAddSubscribers))
+	for subscriptionID, sub := range m.postAddSubscribers {
+		stats := sub.Stats()
+		active = append(active, SubscriptionInfo{
+			ID:       subscriptionID,
+			Kind:     PostAddSubscription,
+			Created:  sub.created,
+			Filtered: sub.filter != nil,
+			Queue:    &stats,
+		})
+	}
+	for subscriptionID, sub := range m.preAddSubscribers {
+		active = append(active, SubscriptionInfo{
+			ID:       subscriptionID,
+			Kind:     PreAddSubscription,
+			Created:  sub.created,
+			Filtered: sub.filter != nil,
+		})
+	}
+	m.lock.RUnlock()
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].ID < active[j].ID
+	})
+	return active
+}
+
+// SubscriberStats reports the state of the notification queue of each
+// post-add subscriber, ordered by subscription ID. Subscribers whose queues
+// are full or whose handlers have been Busy for a long time are not keeping
+// up with the rate at which nodes are added.
+func (m *SubscriberStore) SubscriberStats() []SubscriberStats {
+	m.lock.RLock()
+	stats := make([]SubscriberStats, 0, len(m.postAddSubscribers))
+	for _, sub := range m.postAddSubscribers {
+		stats = append(stats, sub.Stats())
+	}
+	m.lock.RUnlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Subscription < stats[j].Subscription
+	})
+	return stats
 }
 
 func (m *SubscriberStore) CopyInto(s forest.Store) (err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		err = m.store.CopyInto(s)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.CopyInto(s)
 }
 
 func (m *SubscriberStore) Get(id *fields.QualifiedHash) (node forest.Node, present bool, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		node, present, err = m.store.Get(id)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.Get(id)
 }
 
 func (m *SubscriberStore) GetIdentity(id *fields.QualifiedHash) (node forest.Node, present bool, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		node, present, err = m.store.GetIdentity(id)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.GetIdentity(id)
 }
 
 func (m *SubscriberStore) GetCommunity(id *fields.QualifiedHash) (node forest.Node, present bool, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		node, present, err = m.store.GetCommunity(id)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.GetCommunity(id)
 }
 
 func (m *SubscriberStore) GetConversation(communityID, conversationID *fields.QualifiedHash) (node forest.Node, present bool, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		node, present, err = m.store.GetConversation(communityID, conversationID)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.GetConversation(communityID, conversationID)
 }
 
 func (m *SubscriberStore) GetReply(communityID, conversationID, replyID *fields.QualifiedHash) (node forest.Node, present bool, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		node, present, err = m.store.GetReply(communityID, conversationID, replyID)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.GetReply(communityID, conversationID, replyID)
 }
 
 func (m *SubscriberStore) Children(id *fields.QualifiedHash) (ids []*fields.QualifiedHash, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		ids, err = m.store.Children(id)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.Children(id)
 }
 
 func (m *SubscriberStore) Recent(nodeType fields.NodeType, quantity int) (nodes []forest.Node, err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		nodes, err = m.store.Recent(nodeType, quantity)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrStoreClosed
 	}
-	<-done
-	return
+	return m.store.Recent(nodeType, quantity)
 }
 
 // Add inserts a node into the underlying store. Importantly, this will send a notification
 // of a new node to *all* subscribers. If the calling code is a subscriber, it will still
 // be notified of the new node. To supress this, use AddAs() instead.
 func (m *SubscriberStore) Add(node forest.Node) (err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		m.notifySubscribed(m.preAddSubscribers, node, neverAssigned)
-		if err = m.store.Add(node); err == nil {
-			m.notifySubscribed(m.postAddSubscribers, node, neverAssigned)
-		}
-	}
-	<-done
-	return
+	return m.AddAs(node, neverAssigned)
 }
 
 // AddAs allows adding a node to the underlying store without being notified
 // of it as a new node. The addedByID (subscription id returned from SubscribeToNewMessages)
 // will not be notified of the new nodes, but all other subscribers will be.
+//
+// The node is assigned the next sequence number and recorded in the store's
+// ChangeLog. If the change cannot be recorded, the node remains in the store,
+// subscribers are still notified, and the error is returned.
 func (m *SubscriberStore) AddAs(node forest.Node, addedByID Subscription) (err error) {
-	done := make(chan struct{})
-	m.requests <- func() {
-		defer close(done)
-		m.notifySubscribed(m.preAddSubscribers, node, addedByID)
-		if err = m.store.Add(node); err == nil {
-			m.notifySubscribed(m.postAddSubscribers, node, addedByID)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	return m.insert([]forest.Node{node}, addedByID)
+}
+
+// ErrStoreClosed is returned by the methods of a SubscriberStore after it has
+// been closed.
+var ErrStoreClosed = errors.New("store is closed")
+
+// ErrBatchOrder is wrapped by the error returned from AddAll and AddAllAs when
+// a node precedes its parent.
+var ErrBatchOrder = errors.New("node precedes its parent in batch")
+
+// AddAll inserts several nodes into the underlying store at once. See AddAllAs.
+func (m *SubscriberStore) AddAll(nodes []forest.Node) error {
+	return m.AddAllAs(nodes, neverAssigned)
+}
+
+// AddAllAs inserts the given nodes into the underlying store in order,
+// without notifying the addedByID subscription.
+//
+// Every node's parent must either be in the store already or precede it in
+// nodes; otherwise nothing is inserted and the returned error wraps
+// ErrBatchOrder. While the batch is being inserted, readers of the store
+// wait for it to finish, and post-add subscribers receive one notification
+// containing every node that was inserted.
+//
+// The batch is not transactional: the underlying store cannot remove
+// nodes, so if it fails partway through, the nodes inserted before the
+// failure remain, are recorded and notified, and the error is returned.
+// Pre-add handlers are invoked for each node just before it is inserted, so
+// they are never invoked for the nodes after the one that failed (but are
+// invoked for that node itself).
+func (m *SubscriberStore) AddAllAs(nodes []forest.Node, addedByID Subscription) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	inBatch := make(map[string]struct{}, len(nodes))
+	for i, node := range nodes {
+		parentID := node.ParentID()
+		if _, earlier := inBatch[parentID.String()]; !earlier && !parentID.Equals(fields.NullHash()) {
+			if _, has, err := m.store.Get(parentID); err != nil {
+				return fmt.Errorf("failed checking for parent of node %s: %w", node.ID(), err)
+			} else if !has {
+				return fmt.Errorf("%w: node %d (%s) has parent %s, which is neither in the store nor earlier in the batch", ErrBatchOrder, i, node.ID(), parentID)
+			}
 		}
+		inBatch[node.ID().String()] = struct{}{}
 	}
-	<-done
-	return
+	return m.insert(nodes, addedByID)
 }
 
-// notifySubscribed runs all of the subscription handlers in new goroutines with
-// the provided node as input to each handler.
-func (m *SubscriberStore) notifySubscribed(targetMap map[Subscription]func(forest.Node), node forest.Node, ignore Subscription) {
-	for subscriptionID, handler := range targetMap {
-		if subscriptionID != ignore {
-			handler(node)
+// insert adds the given nodes to the underlying store, assigns each a
+// sequence number, and notifies subscribers. The caller must hold the lock.
+//
+// Each node that is inserted is recorded in the store's ChangeLog. If a
+// change cannot be recorded, the node remains in the store, subscribers are
+// still notified, and the error is returned. Insertion stops at the first
+// node that the underlying store fails to add.
+func (m *SubscriberStore) insert(nodes []forest.Node, addedByID Subscription) (err error) {
+	inserted := make([]forest.Node, 0, len(nodes))
+	for _, node := range nodes {
+		m.notifyPresubscribed(node, addedByID)
+		if addErr := m.store.Add(node); addErr != nil {
+			err = addErr
+			break
 		}
+		inserted = append(inserted, node)
+		m.sequence++
+		if logErr := m.changes.Append(Change{Sequence: m.sequence, Node: node}); logErr != nil && err == nil {
+			err = fmt.Errorf("added node %s but failed recording change %d: %w", node.ID(), m.sequence, logErr)
+		}
+	}
+	m.notifySubscribed(inserted, addedByID)
+	return err
+}
+
+// notifyPresubscribed runs all of the pre-add handlers with the provided node
+// as input to each handler. The caller must hold the lock.
+func (m *SubscriberStore) notifyPresubscribed(node forest.Node, ignore Subscription) {
+	for subscriptionID, sub := range m.preAddSubscribers {
+		if subscriptionID == ignore || (sub.filter != nil && !sub.filter(node)) {
+			continue
+		}
+		sub.handler(node)
 	}
 }
 
-// Shut down the worker gorountine that powers this store. Subsequent
-// calls to methods on this MessageStore have undefined behavior
+// notifySubscribed queues the provided nodes for delivery to each post-add
+// subscriber as a single notification. The caller must hold the lock.
+func (m *SubscriberStore) notifySubscribed(nodes []forest.Node, ignore Subscription) {
+	for subscriptionID, sub := range m.postAddSubscribers {
+		if subscriptionID == ignore {
+			continue
+		}
+		if sub.enqueue(nodes, m.Overflow) && m.OnSlowSubscriber != nil {
+			go m.OnSlowSubscriber(sub.Stats())
+		}
+	}
+}
+
+// Close shuts the store down. It waits for operations already in progress
+// to finish, after which every method that returns an error returns
+// ErrStoreClosed and new subscriptions are never notified. Notifications
+// already queued are delivered, and Close waits for the subscribers'
+// goroutines to finish delivering them, so it must not be called from a
+// handler. Finally, the underlying store and ChangeLog are closed if they
+// implement io.Closer, and the first error from closing them is returned.
+//
+// Calling Close more than once returns ErrStoreClosed.
+func (m *SubscriberStore) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return ErrStoreClosed
+	}
+	m.closed = true
+	close(m.closing)
+	subscribers := make([]*subscriber, 0, len(m.postAddSubscribers))
+	for subscriptionID, sub := range m.postAddSubscribers {
+		sub.Finish()
+		subscribers = append(subscribers, sub)
+		delete(m.postAddSubscribers, subscriptionID)
+	}
+	for subscriptionID := range m.preAddSubscribers {
+		delete(m.preAddSubscribers, subscriptionID)
+	}
+	m.lock.Unlock()
+
+	// handlers may still use the store while they finish, which they can
+	// only do once the lock has been released
+	for _, sub := range subscribers {
+		sub.Wait()
+	}
+	var err error
+	if closer, ok := m.store.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil {
+			err = fmt.Errorf("failed closing underlying store: %w", closeErr)
+		}
+	}
+	if closer, ok := m.changes.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed closing change log: %w", closeErr)
+		}
+	}
+	return err
+}
+
+// Destroy closes the store, ignoring any error.
+//
+// Deprecated: use Close.
 func (m *SubscriberStore) Destroy() {
-	close(m.requests)
+	_ = m.Close()
 }
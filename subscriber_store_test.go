@@ -0,0 +1,478 @@
+package sprout_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// slowStore simulates the latency of reading nodes from disk.
+type slowStore struct {
+	*forest.MemoryStore
+	latency time.Duration
+	// entered, if non-nil, receives a value each time a Get begins
+	entered chan struct{}
+	// release, if non-nil, must be closed before a Get can complete
+	release chan struct{}
+}
+
+func (s *slowStore) Get(id *fields.QualifiedHash) (forest.Node, bool, error) {
+	if s.entered != nil {
+		s.entered <- struct{}{}
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	time.Sleep(s.latency)
+	return s.MemoryStore.Get(id)
+}
+
+func TestSubscriberStoreConcurrentReads(t *testing.T) {
+	identity, _, _ := testTree(t)
+	store := &slowStore{
+		MemoryStore: forest.NewMemoryStore(),
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	if err := store.MemoryStore.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	s := sprout.NewSubscriberStore(store)
+	const readers = 4
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, has, err := s.Get(identity.ID()); err != nil || !has {
+				t.Errorf("expected to find identity, has %v err %v", has, err)
+			}
+		}()
+	}
+	// every reader must be inside the underlying store at once before any
+	// of them is allowed to finish
+	for i := 0; i < readers; i++ {
+		select {
+		case <-store.entered:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d reads ran concurrently", i, readers)
+		}
+	}
+	close(store.release)
+	wg.Wait()
+}
+
+func TestSubscriberStoreNotificationOrder(t *testing.T) {
+	identity, _, _ := testTree(t)
+	underlying := forest.NewMemoryStore()
+	s := sprout.NewSubscriberStore(underlying)
+	order := make(chan string, 2)
+	s.PresubscribeToNewMessages(func(n forest.Node) {
+		if _, has, _ := underlying.Get(n.ID()); has {
+			t.Errorf("pre-add handler saw node already in store")
+		}
+		order <- "pre"
+	})
+	s.SubscribeToNewMessages(func(n forest.Node) {
+		// post-add handlers may use the store
+		if _, has, _ := s.Get(n.ID()); !has {
+			t.Errorf("post-add handler saw node missing from store")
+		}
+		order <- "post"
+	})
+	if err := s.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	for _, expected := range []string{"pre", "post"} {
+		select {
+		case got := <-order:
+			if got != expected {
+				t.Fatalf("expected %s notification, got %s", expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s notification", expected)
+		}
+	}
+}
+
+func TestSubscriberStoreSlowSubscriber(t *testing.T) {
+	identity, community, reply := testTree(t)
+	s := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	s.QueueSize = 1
+	s.Overflow = sprout.DropOldest
+	slow := make(chan sprout.SubscriberStats, 1)
+	s.OnSlowSubscriber = func(stats sprout.SubscriberStats) {
+		slow <- stats
+	}
+	release := make(chan struct{})
+	received := make(chan forest.Node, 3)
+	subscription := s.SubscribeToNewMessages(func(n forest.Node) {
+		<-release
+		received <- n
+	})
+	// the first node occupies the handler, the second waits in the queue,
+	// and the third displaces the second
+	for _, node := range []forest.Node{identity, community, reply} {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case stats := <-slow:
+		if stats.Subscription != subscription || stats.Dropped != 1 || stats.Busy == 0 {
+			t.Fatalf("unexpected slow subscriber report: %+v", stats)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("slow subscriber was not reported")
+	}
+	close(release)
+	for _, expected := range []forest.Node{identity, reply} {
+		select {
+		case n := <-received:
+			if !n.Equals(expected) {
+				t.Fatalf("expected %s, got %s", expected.ID(), n.ID())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", expected.ID())
+		}
+	}
+	if stats := s.SubscriberStats(); len(stats) != 1 || stats[0].Dropped != 1 {
+		t.Fatalf("unexpected subscriber stats: %+v", stats)
+	}
+}
+
+// unsignedSigner produces nodes with meaningless signatures, which is all
+// that benchmarks against a store that does not validate need.
+type unsignedSigner struct{}
+
+func (unsignedSigner) Sign(data []byte) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func (unsignedSigner) PublicKey() ([]byte, error) {
+	return []byte("public key"), nil
+}
+
+// benchmarkReads measures Get throughput with the given number of
+// concurrent readers (standing in for Workers) while another goroutine
+// inserts a node every writeEvery.
+func benchmarkReads(b *testing.B, readers int, writeEvery time.Duration) {
+	signer := unsignedSigner{}
+	identity, err := forest.NewIdentity(signer, "reader", "")
+	if err != nil {
+		b.Fatalf("failed creating identity: %v", err)
+	}
+	store := &slowStore{MemoryStore: forest.NewMemoryStore(), latency: 50 * time.Microsecond}
+	if err := store.MemoryStore.Add(identity); err != nil {
+		b.Fatalf("failed adding identity: %v", err)
+	}
+	s := sprout.NewSubscriberStore(store)
+	stop := make(chan struct{})
+	defer close(stop)
+	if writeEvery > 0 {
+		builder := forest.As(identity, signer)
+		go func() {
+			ticker := time.NewTicker(writeEvery)
+			defer ticker.Stop()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				community, err := builder.NewCommunity(fmt.Sprintf("community-%d", i), "")
+				if err != nil {
+					b.Errorf("failed creating community: %v", err)
+					return
+				}
+				if err := s.Add(community); err != nil {
+					b.Errorf("failed adding community: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	b.SetParallelism(readers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, err := s.Get(identity.ID()); err != nil {
+				b.Errorf("failed reading identity: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkSubscriberStoreReads(b *testing.B) {
+	for _, readers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			benchmarkReads(b, readers, 0)
+		})
+	}
+}
+
+func BenchmarkSubscriberStoreReadsWithWrites(b *testing.B) {
+	for _, readers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			benchmarkReads(b, readers, time.Millisecond)
+		})
+	}
+}
+
+func TestSubscriberStoreFilteredSubscription(t *testing.T) {
+	identity, community, reply := testTree(t)
+	otherIdentity, otherCommunity, otherReply := testTree(t)
+	s := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	received := make(chan forest.Node, 6)
+	s.SubscribeToMatchingMessages(sprout.MatchAll(
+		sprout.MatchTypes(fields.NodeTypeReply, fields.NodeTypeCommunity),
+		sprout.MatchCommunities(community.ID()),
+	), func(n forest.Node) {
+		received <- n
+	})
+	var presubscribed []forest.Node
+	s.PresubscribeToMatchingMessages(sprout.MatchAuthors(otherIdentity.ID()), func(n forest.Node) {
+		presubscribed = append(presubscribed, n)
+	})
+	for _, node := range []forest.Node{identity, community, reply, otherIdentity, otherCommunity, otherReply} {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	for _, expected := range []forest.Node{community, reply} {
+		select {
+		case n := <-received:
+			if !n.Equals(expected) {
+				t.Fatalf("expected %T %s, got %T %s", expected, expected.ID(), n, n.ID())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %T", expected)
+		}
+	}
+	select {
+	case n := <-received:
+		t.Fatalf("received unexpected %T %s", n, n.ID())
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(presubscribed) != 3 || !presubscribed[0].Equals(otherIdentity) {
+		t.Fatalf("expected the 3 nodes by the other author, got %d", len(presubscribed))
+	}
+}
+
+func TestSubscriberStoreWatch(t *testing.T) {
+	identity, community, reply := testTree(t)
+	s := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	nodes := s.Watch(ctx, sprout.MatchTypes(fields.NodeTypeReply))
+	for _, node := range []forest.Node{identity, community, reply} {
+		if err := s.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	select {
+	case n := <-nodes:
+		if !n.Equals(reply) {
+			t.Fatalf("expected reply, got %T", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for reply")
+	}
+	cancel()
+	select {
+	case n, open := <-nodes:
+		if open {
+			t.Fatalf("expected channel to close, got %T", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for channel to close")
+	}
+	if stats := s.SubscriberStats(); len(stats) != 0 {
+		t.Fatalf("expected watch to unsubscribe, have %d subscriptions", len(stats))
+	}
+}
+
+func TestSubscriberStoreAddAll(t *testing.T) {
+	identity, community, reply := testTree(t)
+	s := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	batches := make(chan []forest.Node, 2)
+	s.SubscribeToBatches(nil, func(nodes []forest.Node) {
+		batches <- nodes
+	})
+	if err := s.AddAll([]forest.Node{identity, reply, community}); !errors.Is(err, sprout.ErrBatchOrder) {
+		t.Fatalf("expected reply before its community to be rejected, got %v", err)
+	}
+	if _, has, _ := s.Get(identity.ID()); has {
+		t.Fatalf("expected nothing to be inserted from a rejected batch")
+	}
+	if err := s.AddAll([]forest.Node{identity, community, reply}); err != nil {
+		t.Fatalf("failed adding batch: %v", err)
+	}
+	select {
+	case batch := <-batches:
+		if len(batch) != 3 || !batch[2].Equals(reply) {
+			t.Fatalf("expected one notification of 3 nodes, got %d nodes", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for batch notification")
+	}
+	if s.Sequence() != 3 {
+		t.Fatalf("expected each node in the batch to be numbered, sequence is %d", s.Sequence())
+	}
+}
+
+// failingStore refuses to add one particular node.
+type failingStore struct {
+	*forest.MemoryStore
+	refuse *fields.QualifiedHash
+}
+
+func (s *failingStore) Add(node forest.Node) error {
+	if node.ID().Equals(s.refuse) {
+		return errors.New("refused")
+	}
+	return s.MemoryStore.Add(node)
+}
+
+func TestSubscriberStoreAddAllFailure(t *testing.T) {
+	identity, community, reply := testTree(t)
+	s := sprout.NewSubscriberStore(&failingStore{
+		MemoryStore: forest.NewMemoryStore(),
+		refuse:      community.ID(),
+	})
+	var presubscribed []forest.Node
+	s.PresubscribeToNewMessages(func(node forest.Node) {
+		presubscribed = append(presubscribed, node)
+	})
+	batches := make(chan []forest.Node, 1)
+	s.SubscribeToBatches(nil, func(nodes []forest.Node) {
+		batches <- nodes
+	})
+	if err := s.AddAll([]forest.Node{identity, community, reply}); err == nil {
+		t.Fatalf("expected the store's failure to be returned")
+	}
+	if len(presubscribed) != 2 || !presubscribed[1].Equals(community) {
+		t.Fatalf("expected pre-add handlers to stop at the failed node, got %d nodes", len(presubscribed))
+	}
+	if _, has, _ := s.Get(identity.ID()); !has {
+		t.Fatalf("expected the node before the failure to remain")
+	}
+	select {
+	case batch := <-batches:
+		if len(batch) != 1 || !batch[0].Equals(identity) {
+			t.Fatalf("expected notification of only the inserted node, got %d nodes", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for batch notification")
+	}
+	if s.Sequence() != 1 {
+		t.Fatalf("expected only the inserted node to be numbered, sequence is %d", s.Sequence())
+	}
+}
+
+// closableStore records whether it was closed.
+type closableStore struct {
+	*forest.MemoryStore
+	closed bool
+}
+
+func (s *closableStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSubscriberStoreClose(t *testing.T) {
+	identity, community, _ := testTree(t)
+	underlying := &closableStore{MemoryStore: forest.NewMemoryStore()}
+	s := sprout.NewSubscriberStore(underlying)
+	release := make(chan struct{})
+	var delivered []forest.Node
+	s.SubscribeToNewMessages(func(n forest.Node) {
+		<-release
+		// handlers may still use the store while it shuts down
+		if _, _, err := s.Get(n.ID()); !errors.Is(err, sprout.ErrStoreClosed) {
+			t.Errorf("expected closed store to refuse reads, got %v", err)
+		}
+		delivered = append(delivered, n)
+	})
+	watched := s.Watch(context.Background(), nil)
+	if err := s.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- s.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("failed closing store: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out closing store")
+	}
+	if len(delivered) != 1 {
+		t.Fatalf("expected queued notification to be delivered before close, got %d", len(delivered))
+	}
+	if !underlying.closed {
+		t.Fatalf("expected underlying store to be closed")
+	}
+	if err := s.Add(community); !errors.Is(err, sprout.ErrStoreClosed) {
+		t.Fatalf("expected add after close to fail with ErrStoreClosed, got %v", err)
+	}
+	for range watched {
+	}
+	if err := s.Close(); !errors.Is(err, sprout.ErrStoreClosed) {
+		t.Fatalf("expected second close to fail with ErrStoreClosed, got %v", err)
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	identity, _, _ := testTree(t)
+	s := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	pre := s.PresubscribeToNewMessages(func(forest.Node) {})
+	stale := s.SubscribeToNewMessages(func(forest.Node) {})
+	if pre == stale {
+		t.Fatalf("pre-add and post-add subscriptions share ID %d", pre)
+	}
+	s.Unsubscribe(stale)
+	received := make(chan forest.Node, 1)
+	current := s.SubscribeToMatchingMessages(sprout.MatchTypes(fields.NodeTypeIdentity), func(n forest.Node) {
+		received <- n
+	})
+	if current == stale {
+		t.Fatalf("subscription ID %d was reused", stale)
+	}
+	// a stale ID must not suppress notifications to other subscribers
+	if err := s.AddAs(identity, stale); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("current subscriber was not notified")
+	}
+	active := s.ActiveSubscriptions()
+	if len(active) != 2 {
+		t.Fatalf("expected 2 active subscriptions, got %+v", active)
+	}
+	if active[0].ID != pre || active[0].Kind != sprout.PreAddSubscription || active[0].Queue != nil {
+		t.Fatalf("unexpected pre-add subscription info: %+v", active[0])
+	}
+	if active[1].ID != current || !active[1].Filtered || active[1].Queue == nil {
+		t.Fatalf("unexpected post-add subscription info: %+v", active[1])
+	}
+	s.Unsubscribe(pre)
+	if active := s.ActiveSubscriptions(); len(active) != 1 {
+		t.Fatalf("expected pre-add subscription to be removed, got %+v", active)
+	}
+}
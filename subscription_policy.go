@@ -0,0 +1,110 @@
+package sprout
+
+import (
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// SubscriptionPolicy decides which communities a Worker will subscribe to
+// on its peer. It is consulted during BootstrapLocalStore and when the peer
+// announces a community that we did not previously know about.
+type SubscriptionPolicy interface {
+	ShouldSubscribe(community *forest.Community) bool
+}
+
+// SubscriptionPolicyFunc adapts an ordinary function into a SubscriptionPolicy.
+type SubscriptionPolicyFunc func(community *forest.Community) bool
+
+// ShouldSubscribe invokes the underlying function.
+func (f SubscriptionPolicyFunc) ShouldSubscribe(community *forest.Community) bool {
+	return f(community)
+}
+
+// SubscribeAll is a SubscriptionPolicy that accepts every community.
+var SubscribeAll SubscriptionPolicy = SubscriptionPolicyFunc(func(*forest.Community) bool {
+	return true
+})
+
+// CommunityList is a concurrency-safe set of community IDs that can act as
+// either an allowlist or a denylist of communities. Whether it allows or
+// denies the listed communities is fixed when it is created.
+type CommunityList struct {
+	sync.RWMutex
+	// deny inverts the list so that listed communities are rejected and all
+	// others are accepted
+	deny        bool
+	communities map[string]struct{}
+}
+
+var _ SubscriptionPolicy = &CommunityList{}
+
+// AllowCommunities creates a SubscriptionPolicy that accepts only the given
+// communities.
+func AllowCommunities(communityIDs ...*fields.QualifiedHash) *CommunityList {
+	return newCommunityList(false, communityIDs)
+}
+
+// DenyCommunities creates a SubscriptionPolicy that accepts every community
+// except the given ones.
+func DenyCommunities(communityIDs ...*fields.QualifiedHash) *CommunityList {
+	return newCommunityList(true, communityIDs)
+}
+
+func newCommunityList(deny bool, communityIDs []*fields.QualifiedHash) *CommunityList {
+	l := &CommunityList{
+		deny:        deny,
+		communities: make(map[string]struct{}),
+	}
+	for _, id := range communityIDs {
+		l.Add(id)
+	}
+	return l
+}
+
+// Add inserts the given community ID into the list.
+func (l *CommunityList) Add(communityID *fields.QualifiedHash) {
+	l.Lock()
+	defer l.Unlock()
+	l.communities[communityID.String()] = struct{}{}
+}
+
+// Remove deletes the given community ID from the list.
+func (l *CommunityList) Remove(communityID *fields.QualifiedHash) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.communities, communityID.String())
+}
+
+// Denies returns whether the list is a denylist.
+func (l *CommunityList) Denies() bool {
+	return l.deny
+}
+
+// Contains returns whether the given community ID is in the list.
+func (l *CommunityList) Contains(communityID *fields.QualifiedHash) bool {
+	l.RLock()
+	defer l.RUnlock()
+	_, has := l.communities[communityID.String()]
+	return has
+}
+
+// ShouldSubscribe accepts listed communities for an allowlist and unlisted
+// communities for a denylist.
+func (l *CommunityList) ShouldSubscribe(community *forest.Community) bool {
+	return l.Contains(community.ID()) != l.deny
+}
+
+// AllPolicies combines several policies into one that accepts a community only
+// if every one of them does.
+func AllPolicies(policies ...SubscriptionPolicy) SubscriptionPolicy {
+	return SubscriptionPolicyFunc(func(community *forest.Community) bool {
+		for _, policy := range policies {
+			if !policy.ShouldSubscribe(community) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,61 @@
+package sprout_test
+
+import (
+	"testing"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestSubscriptionPolicies(t *testing.T) {
+	_, listed, _ := testTree(t)
+	_, unlisted, _ := testTree(t)
+	allow := sprout.AllowCommunities(listed.ID())
+	deny := sprout.DenyCommunities(listed.ID())
+	for _, test := range []struct {
+		name     string
+		policy   sprout.SubscriptionPolicy
+		expected map[*forest.Community]bool
+	}{
+		{"allow", allow, map[*forest.Community]bool{listed: true, unlisted: false}},
+		{"deny", deny, map[*forest.Community]bool{listed: false, unlisted: true}},
+		{"all", sprout.SubscribeAll, map[*forest.Community]bool{listed: true, unlisted: true}},
+		{"allow and deny", sprout.AllPolicies(allow, deny), map[*forest.Community]bool{listed: false, unlisted: false}},
+		{"allow and all", sprout.AllPolicies(allow, sprout.SubscribeAll), map[*forest.Community]bool{listed: true, unlisted: false}},
+		{"empty combination", sprout.AllPolicies(), map[*forest.Community]bool{listed: true, unlisted: true}},
+	} {
+		for community, expected := range test.expected {
+			if actual := test.policy.ShouldSubscribe(community); actual != expected {
+				t.Errorf("%s: expected %v for community %s, got %v", test.name, expected, community.ID(), actual)
+			}
+		}
+	}
+}
+
+func TestCommunityListUpdates(t *testing.T) {
+	_, community, _ := testTree(t)
+	list := sprout.AllowCommunities()
+	if list.ShouldSubscribe(community) {
+		t.Fatalf("expected empty allowlist to reject community")
+	}
+	list.Add(community.ID())
+	if !list.ShouldSubscribe(community) {
+		t.Fatalf("expected allowlist to accept added community")
+	}
+	list.Remove(community.ID())
+	if list.ShouldSubscribe(community) || list.Contains(community.ID()) {
+		t.Fatalf("expected allowlist to reject removed community")
+	}
+	deny := sprout.DenyCommunities()
+	if !deny.Denies() || !deny.ShouldSubscribe(community) {
+		t.Fatalf("expected empty denylist to accept community")
+	}
+	deny.Add(community.ID())
+	if deny.ShouldSubscribe(community) {
+		t.Fatalf("expected denylist to reject listed community")
+	}
+	deny.Remove(community.ID())
+	if !deny.ShouldSubscribe(community) {
+		t.Fatalf("expected removed community to be accepted by denylist")
+	}
+}
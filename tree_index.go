@@ -0,0 +1,325 @@
+package sprout
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+)
+
+// TreeIndex tracks the shape of the community trees in a store so that
+// leaves_of and list requests can be answered without walking the store.
+// For every indexed community and reply it records the children, for the
+// root of every indexed tree it records the current leaves of the tree
+// newest first, and for every indexed community it records its replies in
+// order of creation.
+//
+// Identities are not part of any tree and are not indexed. Nodes may be
+// added in any order: a node whose parent has not been indexed yet is
+// attached to it once it arrives.
+//
+// The index is kept current by inserting nodes through an IndexingStore,
+// which indexes each node only once it has been added to the store, and is
+// filled with the existing contents of the store by Populate.
+type TreeIndex struct {
+	sync.RWMutex
+	nodes map[string]*indexEntry
+	// detached holds the entries whose parent has not been indexed yet,
+	// keyed by the parent's ID
+	detached map[string][]*indexEntry
+	// replies holds the replies within each community, oldest first
+	replies map[string][]replyRef
+}
+
+// indexEntry records the position of one node within its tree.
+type indexEntry struct {
+	id       *fields.QualifiedHash
+	key      string
+	created  fields.Timestamp
+	parent   *indexEntry
+	children []*indexEntry
+	// leaves holds the leaves of the tree, newest first, if this node is
+	// the root of its tree: a community, or a node whose parent has not
+	// been indexed yet. It is nil for every other node.
+	leaves []*indexEntry
+}
+
+// replyRef identifies a reply by ID and creation time.
+type replyRef struct {
+	id      *fields.QualifiedHash
+	created fields.Timestamp
+}
+
+// NewTreeIndex creates an empty TreeIndex.
+func NewTreeIndex() *TreeIndex {
+	return &TreeIndex{
+		nodes:    make(map[string]*indexEntry),
+		detached: make(map[string][]*indexEntry),
+		replies:  make(map[string][]replyRef),
+	}
+}
+
+// Add indexes the given node. Identities and nodes that are already indexed
+// are ignored.
+func (t *TreeIndex) Add(node forest.Node) {
+	if _, isIdentity := node.(*forest.Identity); isIdentity {
+		return
+	}
+	key := node.ID().String()
+	t.Lock()
+	defer t.Unlock()
+	if _, indexed := t.nodes[key]; indexed {
+		return
+	}
+	entry := &indexEntry{id: node.ID(), key: key}
+	switch n := node.(type) {
+	case *forest.Community:
+		entry.created = n.Created
+	case *forest.Reply:
+		entry.created = n.Created
+		t.addReply(n)
+	}
+	entry.leaves = []*indexEntry{entry}
+	t.nodes[key] = entry
+	parentKey := node.ParentID().String()
+	if parent, indexed := t.nodes[parentKey]; indexed {
+		attach(entry, parent)
+	} else if !node.ParentID().Equals(fields.NullHash()) {
+		t.detached[parentKey] = append(t.detached[parentKey], entry)
+	}
+	for _, child := range t.detached[key] {
+		attach(child, entry)
+	}
+	delete(t.detached, key)
+}
+
+// addReply inserts the reply into its community's list, keeping the list in
+// order of creation.
+func (t *TreeIndex) addReply(reply *forest.Reply) {
+	key := reply.CommunityID.String()
+	replies := t.replies[key]
+	// replies usually arrive in order, so this is almost always an append
+	i := sort.Search(len(replies), func(i int) bool {
+		return replies[i].created > reply.Created
+	})
+	replies = append(replies, replyRef{})
+	copy(replies[i+1:], replies[i:])
+	replies[i] = replyRef{id: reply.ID(), created: reply.Created}
+	t.replies[key] = replies
+}
+
+// attach makes child, which must be the root of its tree, a child of
+// parent, moving the leaves of child's tree to the root of parent's.
+func attach(child, parent *indexEntry) {
+	child.parent = parent
+	wasLeaf := len(parent.children) == 0
+	parent.children = append(parent.children, child)
+	root := parent.root()
+	if wasLeaf {
+		root.removeLeaf(parent)
+	}
+	for _, leaf := range child.leaves {
+		root.insertLeaf(leaf)
+	}
+	child.leaves = nil
+}
+
+// root returns the root of the entry's tree.
+func (e *indexEntry) root() *indexEntry {
+	for e.parent != nil {
+		e = e.parent
+	}
+	return e
+}
+
+// leafIndex returns the position in the root's leaves at which the given
+// leaf is or belongs.
+func (e *indexEntry) leafIndex(leaf *indexEntry) int {
+	return sort.Search(len(e.leaves), func(i int) bool {
+		return !newerLeaf(e.leaves[i], leaf)
+	})
+}
+
+// insertLeaf adds the given leaf to the root's leaves.
+func (e *indexEntry) insertLeaf(leaf *indexEntry) {
+	// leaves are usually the newest nodes, so this is almost always an
+	// insertion at the front
+	i := e.leafIndex(leaf)
+	e.leaves = append(e.leaves, nil)
+	copy(e.leaves[i+1:], e.leaves[i:])
+	e.leaves[i] = leaf
+}
+
+// removeLeaf removes the given leaf from the root's leaves.
+func (e *indexEntry) removeLeaf(leaf *indexEntry) {
+	if i := e.leafIndex(leaf); i < len(e.leaves) && e.leaves[i] == leaf {
+		e.leaves = append(e.leaves[:i], e.leaves[i+1:]...)
+	}
+}
+
+// newerLeaf reports whether leaf a is ordered before leaf b: newest first,
+// with ties broken by ID.
+func newerLeaf(a, b *indexEntry) bool {
+	if a.created != b.created {
+		return a.created > b.created
+	}
+	return a.key < b.key
+}
+
+// Populate indexes up to maxCommunities of the most recent communities in
+// the given store along with every reply within them.
+func (t *TreeIndex) Populate(store forest.Store, maxCommunities int) error {
+	communities, err := store.Recent(fields.NodeTypeCommunity, maxCommunities)
+	if err != nil {
+		return fmt.Errorf("failed listing communities to index: %w", err)
+	}
+	for _, community := range communities {
+		pending := []forest.Node{community}
+		for len(pending) > 0 {
+			node := pending[0]
+			pending = pending[1:]
+			t.Add(node)
+			children, err := store.Children(node.ID())
+			if err != nil {
+				return fmt.Errorf("failed fetching children of %v to index: %w", node.ID(), err)
+			}
+			for _, childID := range children {
+				child, has, err := store.Get(childID)
+				if err != nil {
+					return fmt.Errorf("failed fetching node %v to index: %w", childID, err)
+				} else if !has {
+					continue
+				}
+				pending = append(pending, child)
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the number of indexed nodes.
+func (t *TreeIndex) Len() int {
+	t.RLock()
+	defer t.RUnlock()
+	return len(t.nodes)
+}
+
+// ChildCount returns the number of indexed children of the node with the
+// given ID, and whether that node is indexed.
+func (t *TreeIndex) ChildCount(id *fields.QualifiedHash) (int, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	entry, indexed := t.nodes[id.String()]
+	if !indexed {
+		return 0, false
+	}
+	return len(entry.children), true
+}
+
+// Leaves returns the IDs of the leaves of the subtree rooted at the node
+// with the given ID, newest first, and whether that node is indexed. A node
+// without children is its own leaf.
+func (t *TreeIndex) Leaves(id *fields.QualifiedHash) ([]*fields.QualifiedHash, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	entry, indexed := t.nodes[id.String()]
+	if !indexed {
+		return nil, false
+	}
+	leaves := entry.leaves
+	if entry.parent != nil {
+		// only roots hold their leaves, so collect those of the subtree
+		leaves = nil
+		for pending := []*indexEntry{entry}; len(pending) > 0; {
+			current := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			if len(current.children) == 0 {
+				leaves = append(leaves, current)
+			}
+			pending = append(pending, current.children...)
+		}
+		sort.Slice(leaves, func(i, j int) bool {
+			return newerLeaf(leaves[i], leaves[j])
+		})
+	}
+	ids := make([]*fields.QualifiedHash, len(leaves))
+	for i, leaf := range leaves {
+		ids[i] = leaf.id
+	}
+	return ids, true
+}
+
+// RecentReplies returns the IDs of up to quantity of the most recently
+// created replies within the given communities, newest first. It returns
+// false if any of the communities is not indexed.
+func (t *TreeIndex) RecentReplies(quantity int, communityIDs ...*fields.QualifiedHash) ([]*fields.QualifiedHash, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	var candidates []replyRef
+	if quantity < 1 {
+		quantity = 0
+	}
+	for _, communityID := range communityIDs {
+		key := communityID.String()
+		if _, indexed := t.nodes[key]; !indexed {
+			return nil, false
+		}
+		replies := t.replies[key]
+		if len(replies) > quantity {
+			replies = replies[len(replies)-quantity:]
+		}
+		candidates = append(candidates, replies...)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].created > candidates[j].created
+	})
+	if len(candidates) > quantity {
+		candidates = candidates[:quantity]
+	}
+	ids := make([]*fields.QualifiedHash, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.id
+	}
+	return ids, true
+}
+
+// IndexingStore is a forest.Store that adds every node inserted into
+// another store to a TreeIndex. Nodes are only indexed once the underlying
+// store has accepted them, so the index never holds nodes that failed to be
+// inserted. It can be placed beneath a SubscriberStore, which serializes
+// insertions.
+type IndexingStore struct {
+	forest.Store
+	index *TreeIndex
+}
+
+var _ forest.Store = &IndexingStore{}
+
+// NewIndexingStore wraps the given store so that the nodes added to it are
+// also added to the given index.
+func NewIndexingStore(store forest.Store, index *TreeIndex) *IndexingStore {
+	return &IndexingStore{
+		Store: store,
+		index: index,
+	}
+}
+
+// Add inserts the node into the underlying store and indexes it.
+func (s *IndexingStore) Add(node forest.Node) error {
+	if err := s.Store.Add(node); err != nil {
+		return err
+	}
+	s.index.Add(node)
+	return nil
+}
+
+// Close closes the underlying store if it implements io.Closer.
+func (s *IndexingStore) Close() error {
+	if closer, ok := s.Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package sprout_test
+
+import (
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/testkeys"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestTreeIndex(t *testing.T) {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	builder := forest.As(identity, signer)
+	community, err := builder.NewCommunity(randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	var replies []*forest.Reply
+	for _, parent := range []int{-1, 0, 0, 2} {
+		var parentNode interface{} = community
+		if parent >= 0 {
+			parentNode = replies[parent]
+		}
+		reply, err := builder.NewReply(parentNode, randomString(12), "")
+		if err != nil {
+			t.Fatalf("failed creating reply: %v", err)
+		}
+		replies = append(replies, reply)
+		// give each reply a distinct timestamp so that leaves are ordered
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	store := forest.NewMemoryStore()
+	for _, node := range []forest.Node{identity, community, replies[0], replies[1]} {
+		if err := store.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	index := sprout.NewTreeIndex()
+	if err := index.Populate(store, 10); err != nil {
+		t.Fatalf("failed populating index: %v", err)
+	}
+	// add the last reply before its parent to exercise reattachment
+	index.Add(replies[3])
+	index.Add(replies[2])
+
+	leaves, indexed := index.Leaves(community.ID())
+	if !indexed {
+		t.Fatalf("expected community to be indexed")
+	}
+	if len(leaves) != 2 || !leaves[0].Equals(replies[3].ID()) || !leaves[1].Equals(replies[1].ID()) {
+		t.Fatalf("expected leaves of community newest first, got %v", leaves)
+	}
+	if leaves, _ := index.Leaves(replies[0].ID()); len(leaves) != 2 || !leaves[0].Equals(replies[3].ID()) || !leaves[1].Equals(replies[1].ID()) {
+		t.Fatalf("expected leaves of reply newest first, got %v", leaves)
+	}
+	if leaves, _ := index.Leaves(replies[1].ID()); len(leaves) != 1 || !leaves[0].Equals(replies[1].ID()) {
+		t.Fatalf("expected leaf to be its own leaf, got %v", leaves)
+	}
+	if count, _ := index.ChildCount(replies[0].ID()); count != 2 {
+		t.Fatalf("expected 2 children, got %d", count)
+	}
+	if _, indexed := index.Leaves(identity.ID()); indexed {
+		t.Fatalf("expected identity not to be indexed")
+	}
+
+	recent, indexed := index.RecentReplies(2, community.ID())
+	if !indexed || len(recent) != 2 {
+		t.Fatalf("expected 2 recent replies, got %v", recent)
+	}
+	if _, indexed := index.RecentReplies(2, identity.ID()); indexed {
+		t.Fatalf("expected unindexed community to be reported")
+	}
+}
+
+func TestIndexingStore(t *testing.T) {
+	identity, community, reply := testTree(t)
+	index := sprout.NewTreeIndex()
+	store := sprout.NewIndexingStore(&failingStore{
+		MemoryStore: forest.NewMemoryStore(),
+		refuse:      reply.ID(),
+	}, index)
+	for _, node := range []forest.Node{identity, community} {
+		if err := store.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if err := store.Add(reply); err == nil {
+		t.Fatalf("expected the underlying store's failure to be returned")
+	}
+	if index.Len() != 1 {
+		t.Fatalf("expected only the community to be indexed, have %d nodes", index.Len())
+	}
+	if leaves, _ := index.Leaves(community.ID()); len(leaves) != 1 || !leaves[0].Equals(community.ID()) {
+		t.Fatalf("expected the failed reply not to be a leaf, got %v", leaves)
+	}
+}
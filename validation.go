@@ -0,0 +1,132 @@
+package sprout
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	"git.sr.ht/~whereswaldon/forest-go"
+)
+
+// ValidationPool verifies nodes on a fixed number of goroutines. It bounds
+// the CPU spent on signature checks no matter how many nodes are submitted
+// concurrently, while still checking batches of nodes in parallel.
+//
+// A single ValidationPool is intended to be shared by every Worker in a
+// process. Workers use the pool returned by DefaultValidationPool unless
+// configured otherwise.
+type ValidationPool struct {
+	jobs chan validationJob
+}
+
+type validationJob struct {
+	node   forest.Node
+	store  forest.Store
+	result chan<- error
+}
+
+// NewValidationPool starts a pool that verifies up to parallelism nodes at
+// once. If parallelism is less than one, the number of CPUs is used.
+func NewValidationPool(parallelism int) *ValidationPool {
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
+	}
+	p := &ValidationPool{
+		jobs: make(chan validationJob),
+	}
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			for job := range p.jobs {
+				job.result <- VerifyNode(job.node, job.store)
+			}
+		}()
+	}
+	return p
+}
+
+var (
+	defaultValidationPool     *ValidationPool
+	defaultValidationPoolOnce sync.Once
+)
+
+// DefaultValidationPool returns a process-wide pool with one goroutine per CPU.
+func DefaultValidationPool() *ValidationPool {
+	defaultValidationPoolOnce.Do(func() {
+		defaultValidationPool = NewValidationPool(runtime.NumCPU())
+	})
+	return defaultValidationPool
+}
+
+// Verify checks the given node with VerifyNode on one of the pool's
+// goroutines, blocking until the result is available.
+func (p *ValidationPool) Verify(node forest.Node, store forest.Store) error {
+	result := make(chan error, 1)
+	p.jobs <- validationJob{node: node, store: store, result: result}
+	return <-result
+}
+
+// VerifyAll checks each of the given nodes with VerifyNode in parallel and
+// returns the result for each node at the same index as the node.
+func (p *ValidationPool) VerifyAll(nodes []forest.Node, store forest.Store) []error {
+	results := make([]chan error, len(nodes))
+	for i, node := range nodes {
+		results[i] = make(chan error, 1)
+		p.jobs <- validationJob{node: node, store: store, result: results[i]}
+	}
+	errs := make([]error, len(nodes))
+	for i := range results {
+		errs[i] = <-results[i]
+	}
+	return errs
+}
+
+// Stop shuts down the pool's goroutines. The pool must not be used
+// afterward.
+func (p *ValidationPool) Stop() {
+	close(p.jobs)
+}
+
+// VerifyNode checks the internal validity of the given node and its
+// signature. The node's author (if any) must be present in the given store.
+// It does not check that the other nodes the node references are present;
+// use the node's ValidateDeep method for that.
+func VerifyNode(node forest.Node, store forest.Store) error {
+	if err := node.ValidateShallow(); err != nil {
+		return err
+	}
+	var (
+		validator forest.SignatureValidator
+		author    *forest.Identity
+	)
+	switch n := node.(type) {
+	case *forest.Identity:
+		// identities sign themselves
+		validator, author = n, n
+	case *forest.Community:
+		validator = n
+	case *forest.Reply:
+		validator = n
+	default:
+		return fmt.Errorf("unsupported type in VerifyNode: %T", node)
+	}
+	if author == nil {
+		authorID := validator.SignatureIdentityHash()
+		authorNode, has, err := store.GetIdentity(authorID)
+		if err != nil {
+			return fmt.Errorf("failed looking up author %s: %w", authorID, err)
+		} else if !has {
+			return fmt.Errorf("missing author %s", authorID)
+		}
+		var isIdentity bool
+		author, isIdentity = authorNode.(*forest.Identity)
+		if !isIdentity {
+			return fmt.Errorf("author %s is a %T, not an identity", authorID, authorNode)
+		}
+	}
+	if valid, err := forest.ValidateSignature(validator, author); err != nil {
+		return fmt.Errorf("failed checking signature: %w", err)
+	} else if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
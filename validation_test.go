@@ -0,0 +1,45 @@
+package sprout_test
+
+import (
+	"sync"
+	"testing"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+func TestValidationPool(t *testing.T) {
+	identity, community, reply := testTree(t)
+	forged := *reply
+	forged.Content.Blob = fields.Blob("forged")
+	store := forest.NewMemoryStore()
+	if err := store.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	pool := sprout.NewValidationPool(2)
+	defer pool.Stop()
+
+	errs := pool.VerifyAll([]forest.Node{identity, community, reply, &forged}, store)
+	for i, err := range errs[:3] {
+		if err != nil {
+			t.Errorf("expected node %d to be valid, got %v", i, err)
+		}
+	}
+	if errs[3] == nil {
+		t.Errorf("expected forged reply to be rejected")
+	}
+
+	// more concurrent callers than goroutines must all be served
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.Verify(reply, store); err != nil {
+				t.Errorf("expected reply to be valid, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"git.sr.ht/~whereswaldon/forest-go"
@@ -19,6 +20,18 @@ type SubscribableStore interface {
 	AddAs(forest.Node, Subscription) (err error)
 }
 
+// filteredSubscriber is implemented by stores (such as SubscriberStore) that
+// can filter the nodes delivered to a subscription themselves.
+type filteredSubscriber interface {
+	SubscribeToMatchingMessages(NodeFilter, func(forest.Node)) Subscription
+}
+
+// batchAdder is implemented by stores (such as SubscriberStore) that can
+// insert several nodes at once.
+type batchAdder interface {
+	AddAllAs([]forest.Node, Subscription) error
+}
+
 type Worker struct {
 	Done           <-chan struct{}
 	DefaultTimeout time.Duration
@@ -26,7 +39,104 @@ type Worker struct {
 	*log.Logger
 	*Session
 	SubscribableStore
-	subscriptionID Subscription
+	// SubscriptionPolicy selects the communities that this worker will
+	// subscribe to on its peer. If nil, BootstrapLocalStore subscribes to
+	// every community the peer lists and newly-announced communities are
+	// not subscribed to automatically.
+	SubscriptionPolicy
+	// AnnounceBatchSize is the maximum number of nodes sent in a single
+	// announce message.
+	AnnounceBatchSize int
+	// AnnounceInterval is the longest that a new node will wait in the
+	// announce queue before being sent to the peer. If it is not positive,
+	// nodes are sent as soon as no more are waiting.
+	AnnounceInterval time.Duration
+	// AnnounceQueueSize bounds the number of new nodes waiting to be
+	// announced. Nodes that arrive while the queue is full are dropped.
+	// Changes take effect the next time Run is called.
+	AnnounceQueueSize int
+	// OrphanTimeout is how long a node that could not be validated is held
+	// while waiting for the nodes that it references to arrive.
+	OrphanTimeout time.Duration
+	// Inflight deduplicates concurrent ingestion and fetches of the same
+	// nodes. NewWorker creates one for each worker, but it can be replaced
+	// with one shared by every worker using the same store.
+	Inflight *InflightGroup
+	// Validation is the pool used to check the signatures of nodes
+	// received from the peer. NewWorker uses DefaultValidationPool.
+	Validation *ValidationPool
+	// SynchronousAnnounce makes the worker finish ingesting announced nodes
+	// before replying to an announce message, so that the status reflects
+	// whether the nodes were accepted. The status is ErrorMalformed if any
+	// node failed validation, or else ErrorRejected if any node was refused
+	// by the ContentPolicy or is a reply in a community that we are not
+	// subscribed to. As the status covers the whole message, peers can use
+	// SendAnnounceAndVerify to learn which nodes were accepted. Ingestion is
+	// limited to IngestTimeout, after which any nodes still being ingested
+	// are not counted as rejected.
+	SynchronousAnnounce bool
+	IngestTimeout       time.Duration
+	// ContentPolicy, if set, is consulted before inserting any node received
+	// from the peer into the store and before sending any node to the peer.
+	ContentPolicy
+	// Quarantine, if set, receives every node from the peer that is
+	// rejected by validation or by the ContentPolicy.
+	Quarantine *Quarantine
+	// Provenance records the peer and arrival of every node that this
+	// worker inserts into the store. NewWorker creates one for each worker,
+	// but it can be replaced with one shared by every worker using the same
+	// store.
+	Provenance *ProvenanceIndex
+	// Index, if set, is used to answer leaves_of requests without
+	// searching the store. It must be kept current with the store's
+	// contents, such as by inserting nodes through an IndexingStore.
+	Index *TreeIndex
+	// ScopeReplyLists limits the replies listed for the peer to those in
+	// the communities that it is subscribed to, if it is subscribed to any.
+	// It has no effect unless Index is set.
+	ScopeReplyLists bool
+	// PeerAddress identifies the peer in quarantine and provenance records.
+	// NewWorker sets it to the host of the connection's remote address, as
+	// the port changes with every connection. Workers that dialed their
+	// peer may set it to the address they dialed instead.
+	PeerAddress string
+	// subscriptionLock serializes changes to the communities that we are
+	// subscribed to on the peer
+	subscriptionLock sync.Mutex
+	subscriptionID   Subscription
+	announceQueue    chan forest.Node
+	statsLock        sync.Mutex
+	announceStats    AnnounceStats
+	// knownNodes holds the IDs of nodes that the peer is known to have,
+	// either because it announced or sent them to us or because it
+	// acknowledged our announcement of them.
+	knownNodes *knownNodes
+	// orphans holds nodes that failed validation because of missing
+	// references, and orphanSubscriptionID is used to learn when those
+	// references are added to the store
+	orphans              *orphanPool
+	orphanSubscriptionID Subscription
+	// ready is closed once Run has subscribed to the store
+	ready chan struct{}
+}
+
+// AnnounceStats reports the activity of a Worker's announce queue. Each
+// field counts nodes except for Batches, which counts announce messages.
+type AnnounceStats struct {
+	// Queued nodes were accepted into the announce queue.
+	Queued uint64
+	// Dropped nodes were discarded because the announce queue was full or
+	// because the worker stopped before they were sent.
+	Dropped uint64
+	// Suppressed nodes were not queued because the peer is known to
+	// already have them.
+	Suppressed uint64
+	// Announced nodes were acknowledged by the peer.
+	Announced uint64
+	// Failed nodes were sent in an announce message that failed or timed out.
+	Failed uint64
+	// Batches is the number of announce messages sent.
+	Batches uint64
 }
 
 func NewWorker(done <-chan struct{}, conn net.Conn, store SubscribableStore) (*Worker, error) {
@@ -35,6 +145,13 @@ func NewWorker(done <-chan struct{}, conn net.Conn, store SubscribableStore) (*W
 		SubscribableStore: store,
 		Logger:            log.New(log.Writer(), "", log.LstdFlags|log.Lshortfile),
 		DefaultTimeout:    time.Minute,
+		AnnounceBatchSize: 128,
+		AnnounceInterval:  500 * time.Millisecond,
+		AnnounceQueueSize: 4096,
+		OrphanTimeout:     10 * time.Minute,
+		IngestTimeout:     30 * time.Second,
+		PeerAddress:       peerHost(conn.RemoteAddr()),
+		ready:             make(chan struct{}),
 	}
 	var err error
 	w.Conn, err = NewConn(conn)
@@ -42,6 +159,11 @@ func NewWorker(done <-chan struct{}, conn net.Conn, store SubscribableStore) (*W
 		return nil, fmt.Errorf("failed to create sprout conn: %w", err)
 	}
 	w.Session = NewSession()
+	w.knownNodes = newKnownNodes(defaultKnownNodeCapacity, defaultKnownNodeLifetime)
+	w.orphans = newOrphanPool(defaultMaxOrphans)
+	w.Inflight = NewInflightGroup()
+	w.Provenance = NewProvenanceIndex()
+	w.Validation = DefaultValidationPool()
 	w.Conn.OnVersion = w.OnVersion
 	w.Conn.OnList = w.OnList
 	w.Conn.OnQuery = w.OnQuery
@@ -62,8 +184,22 @@ func (c *Worker) Run() {
 		c.Printf("Closed network connection")
 	}()
 	defer c.Printf("Shutting down")
-	c.subscriptionID = c.SubscribableStore.SubscribeToNewMessages(c.HandleNewNode)
+	defer func() {
+		c.Printf("Announce stats: %+v", c.AnnounceStats())
+	}()
+	stopAnnouncing := make(chan struct{})
+	defer close(stopAnnouncing)
+	c.announceQueue = make(chan forest.Node, c.AnnounceQueueSize)
+	go c.announceLoop(c.announceQueue, stopAnnouncing)
+	if filtered, ok := c.SubscribableStore.(filteredSubscriber); ok {
+		c.subscriptionID = filtered.SubscribeToMatchingMessages(c.peerWants, c.HandleNewNode)
+	} else {
+		c.subscriptionID = c.SubscribableStore.SubscribeToNewMessages(c.HandleNewNode)
+	}
 	defer c.SubscribableStore.UnsubscribeToNewMessages(c.subscriptionID)
+	c.orphanSubscriptionID = c.SubscribableStore.SubscribeToNewMessages(c.adoptOrphans)
+	defer c.SubscribableStore.UnsubscribeToNewMessages(c.orphanSubscriptionID)
+	close(c.ready)
 	for {
 		if err := c.ReadMessage(); err != nil {
 			var unsolicitedErr UnsolicitedMessageError
@@ -83,29 +219,151 @@ func (c *Worker) Run() {
 	}
 }
 
-// Asynchronously announce new node if appropriate
+// Ready returns a channel that is closed once Run has subscribed to the
+// worker's store, after which every node added to the store is considered
+// for announcement to the peer.
+func (c *Worker) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// HandleNewNode queues the given node to be announced to the peer if
+// appropriate. Nodes that the peer is known to have already are skipped.
+// Queued nodes are announced in batches by the worker's announce loop. If
+// the queue is full, the node is dropped and counted in the worker's
+// AnnounceStats.
 func (c *Worker) HandleNewNode(node forest.Node) {
-	go func() {
-		switch n := node.(type) {
-		// TODO: DRY this out
-		case *forest.Identity:
-			if err := c.SendAnnounce([]forest.Node{n}, makeTicker(c.DefaultTimeout)); err != nil {
-				c.Printf("Error announcing new identity: %v", err)
+	if !c.peerWants(node) {
+		return
+	}
+	if c.ContentPolicy != nil {
+		if err := c.AllowServe(node); err != nil {
+			c.Printf("Not announcing node %s: %v", node.ID(), err)
+			return
+		}
+	}
+	if c.knownNodes.Has(node.ID()) {
+		c.updateAnnounceStats(func(stats *AnnounceStats) {
+			stats.Suppressed++
+		})
+		return
+	}
+	select {
+	case c.announceQueue <- node:
+		c.updateAnnounceStats(func(stats *AnnounceStats) {
+			stats.Queued++
+		})
+	default:
+		c.updateAnnounceStats(func(stats *AnnounceStats) {
+			stats.Dropped++
+		})
+	}
+}
+
+// peerWants returns whether the peer should be told about the given node:
+// all identities and communities, and replies within the communities that
+// the peer is subscribed to.
+func (c *Worker) peerWants(node forest.Node) bool {
+	switch n := node.(type) {
+	case *forest.Identity, *forest.Community:
+		return true
+	case *forest.Reply:
+		return c.IsPeerSubscribed(&n.CommunityID)
+	default:
+		return false
+	}
+}
+
+// AnnounceStats returns a snapshot of the worker's announce queue counters.
+func (c *Worker) AnnounceStats() AnnounceStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	return c.announceStats
+}
+
+func (c *Worker) updateAnnounceStats(update func(*AnnounceStats)) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	update(&c.announceStats)
+}
+
+// announceLoop collects nodes from the announce queue and sends them to the
+// peer once AnnounceBatchSize nodes are waiting or AnnounceInterval elapses,
+// whichever comes first. If AnnounceInterval is not positive, nodes are sent
+// as soon as the queue is empty. It returns when stop is closed, counting
+// any nodes that were not yet sent as dropped.
+func (c *Worker) announceLoop(queue <-chan forest.Node, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if c.AnnounceInterval > 0 {
+		ticker := time.NewTicker(c.AnnounceInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	batch := make([]forest.Node, 0, c.AnnounceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		_, _ = c.announceBatch(batch)
+		batch = make([]forest.Node, 0, c.AnnounceBatchSize)
+	}
+	for {
+		select {
+		case node := <-queue:
+			batch = append(batch, node)
+			if len(batch) >= c.AnnounceBatchSize || (tick == nil && len(queue) == 0) {
+				flush()
 			}
-		case *forest.Community:
-			if err := c.SendAnnounce([]forest.Node{n}, makeTicker(c.DefaultTimeout)); err != nil {
-				c.Printf("Error announcing new community: %v", err)
+		case <-tick:
+			flush()
+		case <-stop:
+			// the connection is closing, so the nodes cannot be announced
+			dropped := len(batch) + len(queue)
+			if dropped > 0 {
+				c.updateAnnounceStats(func(stats *AnnounceStats) {
+					stats.Dropped += uint64(dropped)
+				})
 			}
-		case *forest.Reply:
-			if c.IsSubscribed(&n.CommunityID) {
-				if err := c.SendAnnounce([]forest.Node{n}, time.NewTicker(c.DefaultTimeout).C); err != nil {
-					c.Printf("Error announcing new reply: %v", err)
-				}
+			return
+		}
+	}
+}
+
+// announceBatch sends the given nodes to the peer in announce messages of
+// at most AnnounceBatchSize nodes each, recording the outcome in the
+// worker's AnnounceStats. It returns the number of nodes acknowledged by
+// the peer and the first error encountered.
+func (c *Worker) announceBatch(nodes []forest.Node) (announced int, err error) {
+	batchSize := c.AnnounceBatchSize
+	if batchSize < 1 {
+		batchSize = len(nodes)
+	}
+	for len(nodes) > 0 {
+		size := batchSize
+		if size > len(nodes) {
+			size = len(nodes)
+		}
+		batch := nodes[:size]
+		nodes = nodes[size:]
+		sendErr := c.SendAnnounce(batch, makeTicker(c.DefaultTimeout))
+		c.updateAnnounceStats(func(stats *AnnounceStats) {
+			stats.Batches++
+			if sendErr != nil {
+				stats.Failed += uint64(len(batch))
+			} else {
+				stats.Announced += uint64(len(batch))
 			}
-		default:
-			log.Printf("Unknown node type: %T", n)
+		})
+		if sendErr != nil {
+			c.Printf("Error announcing %d nodes: %v", len(batch), sendErr)
+			if err == nil {
+				err = sendErr
+			}
+			continue
 		}
-	}()
+		c.markKnown(batch...)
+		announced += len(batch)
+	}
+	return announced, err
 }
 
 func (c *Worker) OnVersion(s *Conn, messageID MessageID, major, minor int) error {
@@ -130,26 +388,47 @@ func (c *Worker) OnVersion(s *Conn, messageID MessageID, major, minor int) error
 
 func (c *Worker) OnList(s *Conn, messageID MessageID, nodeType fields.NodeType, quantity int) error {
 	c.Printf("Received list: id:%d type:%d quantity:%d", messageID, nodeType, quantity)
+	if c.ScopeReplyLists && c.Index != nil && nodeType == fields.NodeTypeReply {
+		if communities := c.PeerSubscriptions(); len(communities) > 0 {
+			if ids, indexed := c.Index.RecentReplies(quantity, communities...); indexed {
+				nodes, err := c.getAll(ids)
+				if err != nil {
+					return fmt.Errorf("failed listing recent replies: %w", err)
+				}
+				return s.SendResponse(messageID, c.servable(nodes))
+			}
+		}
+	}
 	// requires better iteration on Store types
 	nodes, err := c.SubscribableStore.Recent(nodeType, quantity)
 	if err != nil {
 		return fmt.Errorf("failed listing recent nodes of type %d: %w", nodeType, err)
 	}
-	return s.SendResponse(messageID, nodes)
+	return s.SendResponse(messageID, c.servable(nodes))
 }
 
 func (c *Worker) OnQuery(s *Conn, messageID MessageID, nodeIds []*fields.QualifiedHash) error {
 	c.Printf("Received query: id:%d quantity:%d", messageID, len(nodeIds))
-	results := make([]forest.Node, 0, len(nodeIds))
-	for _, id := range nodeIds {
+	results, err := c.getAll(nodeIds)
+	if err != nil {
+		return err
+	}
+	return s.SendResponse(messageID, c.servable(results))
+}
+
+// getAll fetches the nodes with the given IDs from the store, skipping any
+// that are not present.
+func (c *Worker) getAll(ids []*fields.QualifiedHash) ([]forest.Node, error) {
+	nodes := make([]forest.Node, 0, len(ids))
+	for _, id := range ids {
 		node, present, err := c.SubscribableStore.Get(id)
 		if err != nil {
-			return fmt.Errorf("failed checking for node %v in store: %w", id, err)
+			return nil, fmt.Errorf("failed checking for node %v in store: %w", id, err)
 		} else if present {
-			results = append(results, node)
+			nodes = append(nodes, node)
 		}
 	}
-	return s.SendResponse(messageID, results)
+	return nodes, nil
 }
 
 func (c *Worker) OnAncestry(s *Conn, messageID MessageID, nodeID *fields.QualifiedHash, levels int) error {
@@ -180,11 +459,31 @@ func (c *Worker) OnAncestry(s *Conn, messageID MessageID, nodeID *fields.Qualifi
 	sort.Slice(ancestors, func(i, j int) bool {
 		return ancestors[i].TreeDepth() < ancestors[j].TreeDepth()
 	})
-	return s.SendResponse(messageID, ancestors)
+	return s.SendResponse(messageID, c.servableAncestors(ancestors))
 }
 
 func (c *Worker) OnLeavesOf(s *Conn, messageID MessageID, nodeID *fields.QualifiedHash, quantity int) error {
 	c.Printf("Received leaves_of: id:%d node:%s quantity:%d", messageID, nodeID, quantity)
+	if c.Index != nil {
+		if ids, indexed := c.Index.Leaves(nodeID); indexed {
+			// the leaves are ordered, so only fetch as many as are needed
+			// to fill the response
+			leaves := make([]forest.Node, 0)
+			for len(ids) > 0 && len(leaves) < quantity {
+				batch := ids
+				if len(batch) > quantity-len(leaves) {
+					batch = batch[:quantity-len(leaves)]
+				}
+				ids = ids[len(batch):]
+				nodes, err := c.getAll(batch)
+				if err != nil {
+					return fmt.Errorf("failed fetching leaves of %v: %w", nodeID, err)
+				}
+				leaves = append(leaves, c.servable(nodes)...)
+			}
+			return s.SendResponse(messageID, leaves)
+		}
+	}
 	descendants := make([]*fields.QualifiedHash, 0, 1024)
 	descendants = append(descendants, nodeID)
 	leaves := make([]forest.Node, 0, 1024)
@@ -213,6 +512,7 @@ func (c *Worker) OnLeavesOf(s *Conn, messageID MessageID, nodeID *fields.Qualifi
 			}
 		}
 	}
+	leaves = c.servable(leaves)
 	if len(leaves) > quantity {
 		leaves = leaves[:quantity]
 	}
@@ -226,7 +526,14 @@ func (c *Worker) OnSubscribe(s *Conn, messageID MessageID, nodeID *fields.Qualif
 			err = fmt.Errorf("Error during subscribe: %w", err)
 		}
 	}()
-	c.Subscribe(nodeID)
+	if err := c.SubscribePeer(nodeID); err != nil {
+		c.Printf("Rejecting subscribe to %s: %v", nodeID, err)
+		// the protocol has no dedicated status for exceeding a limit
+		if err := s.SendStatus(messageID, ErrorMalformed); err != nil {
+			return fmt.Errorf("Failed to send error status: %w", err)
+		}
+		return nil
+	}
 	if err := s.SendStatus(messageID, StatusOk); err != nil {
 		return fmt.Errorf("Failed to send okay status: %w", err)
 	}
@@ -240,7 +547,7 @@ func (c *Worker) OnUnsubscribe(s *Conn, messageID MessageID, nodeID *fields.Qual
 			err = fmt.Errorf("Error during unsubscribe: %w", err)
 		}
 	}()
-	c.Unsubscribe(nodeID)
+	c.UnsubscribePeer(nodeID)
 	if err := s.SendStatus(messageID, StatusOk); err != nil {
 		return fmt.Errorf("Failed to send okay status: %w", err)
 	}
@@ -255,49 +562,206 @@ func (c *Worker) OnUnsubscribe(s *Conn, messageID MessageID, nodeID *fields.Qual
 // then it will attempt to re-validate the original node after processing its
 // entire ancestry.
 //
-// It will return the first error during this chain of validations.
+// It will return the first error during this chain of validations. If the
+// node still references nodes that are unavailable, it is held in the
+// worker's orphan pool and retried automatically when those nodes are added
+// to the store. In that case, the returned error wraps ErrOrphaned.
+//
+// Concurrent calls to ingest the same node (through this worker or any other
+// sharing its Inflight group) wait for the first one and share its result,
+// unless it fails, in which case they try again with their own peer.
 func (c *Worker) IngestNode(node forest.Node) error {
-	timeout := c.DefaultTimeout
-	if err := c.ensureAuthorAvailable(node, timeout); err != nil {
-		return err
+	return c.doShared("ingest", node.ID(), func() error {
+		if _, alreadyInStore, err := c.SubscribableStore.Get(node.ID()); err != nil {
+			return fmt.Errorf("failed checking whether %s is already in the store: %w", node.ID(), err)
+		} else if alreadyInStore {
+			// a previous ingest of this node completed
+			return nil
+		}
+		err := c.ingestNode(node)
+		if err == nil {
+			return nil
+		} else if errors.Is(err, ErrPolicyViolation) {
+			c.quarantine(node, err)
+			return err
+		}
+		missing, checkErr := c.missingReferences(node)
+		if checkErr != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			// the nodes that were missing may have been inserted since
+			// ingestion failed, so try once more before giving up
+			if err = c.ingestNode(node); err == nil {
+				return nil
+			}
+			if missing, checkErr = c.missingReferences(node); checkErr != nil {
+				return err
+			} else if errors.Is(err, ErrPolicyViolation) || len(missing) == 0 {
+				c.quarantine(node, err)
+				return err
+			}
+		}
+		if !c.orphans.Add(node, missing, time.Now().Add(c.OrphanTimeout)) {
+			err = fmt.Errorf("orphan pool full, discarding node %s: %w", node.ID(), err)
+			c.quarantine(node, err)
+			return err
+		}
+		// a missing node inserted before the orphan was added to the pool
+		// would never resolve it, so check for them again
+		for _, id := range missing {
+			if _, has, err := c.SubscribableStore.Get(id); err == nil && has {
+				c.resolveOrphans(id)
+			}
+		}
+		return fmt.Errorf("%w (waiting for %d nodes): %v", ErrOrphaned, len(missing), err)
+	})
+}
+
+// OrphanCount returns the number of nodes waiting in the worker's orphan pool.
+func (c *Worker) OrphanCount() int {
+	return c.orphans.Len()
+}
+
+// missingReferences returns the IDs of the nodes referenced by the given
+// node that are not present in the store.
+func (c *Worker) missingReferences(node forest.Node) ([]*fields.QualifiedHash, error) {
+	referenced := []*fields.QualifiedHash{node.ParentID()}
+	switch n := node.(type) {
+	case *forest.Community:
+		referenced = append(referenced, &n.Author)
+	case *forest.Reply:
+		referenced = append(referenced, &n.Author, &n.CommunityID)
+		if n.Depth > fields.TreeDepth(1) {
+			referenced = append(referenced, &n.ConversationID)
+		}
 	}
-	if err := node.ValidateDeep(c.SubscribableStore); err != nil {
-		ancestry, err := c.SendAncestry(node.ID(), int(node.TreeDepth()), makeTicker(timeout))
-		if err != nil {
-			return fmt.Errorf("validation unable to fetch ancestry for node %s: %w", node.ID(), err)
+	missing := make([]*fields.QualifiedHash, 0, len(referenced))
+	for _, id := range referenced {
+		if id.Equals(fields.NullHash()) {
+			continue
 		}
-		for _, ancestor := range ancestry.Nodes {
-			if _, alreadyHas, err := c.SubscribableStore.Get(ancestor.ID()); err != nil {
-				return fmt.Errorf("unable to check whether %s is in local store: %w", ancestor.ID(), err)
-			} else if alreadyHas {
-				// we already have this ancestor, no need to validate it again
+		if _, has, err := c.SubscribableStore.Get(id); err != nil {
+			return nil, fmt.Errorf("failed checking for referenced node %s: %w", id, err)
+		} else if !has {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+// adoptOrphans retries the ingestion of any orphans that were waiting for
+// the given node. It is invoked for every node added to the store.
+func (c *Worker) adoptOrphans(node forest.Node) {
+	c.resolveOrphans(node.ID())
+}
+
+// resolveOrphans retries the ingestion of any orphans that were waiting for
+// the node with the given ID, which must be in the store.
+func (c *Worker) resolveOrphans(id *fields.QualifiedHash) {
+	orphans := c.orphans.Resolve(id)
+	if len(orphans) == 0 {
+		return
+	}
+	go func() {
+		for _, orphan := range orphans {
+			missing, err := c.missingReferences(orphan)
+			if err != nil {
+				c.Printf("Failed checking references of orphan %s: %v", orphan.ID(), err)
 				continue
 			}
-			if err := c.ensureAuthorAvailable(ancestor, timeout); err != nil {
-				return fmt.Errorf("validation unable to fetch author for ancestor %s: %w", ancestor.ID(), err)
+			if len(missing) > 0 {
+				if !c.orphans.Add(orphan, missing, time.Now().Add(c.OrphanTimeout)) {
+					c.Printf("Orphan pool full, discarding node %s", orphan.ID())
+					c.quarantine(orphan, fmt.Errorf("orphan pool full"))
+				}
+				continue
 			}
-			if err := ancestor.ValidateDeep(c.SubscribableStore); err != nil {
-				return fmt.Errorf("validation failed for ancestor %s: %w", ancestor.ID(), err)
+			if err := c.validate(orphan, ViaAnnounce); err != nil {
+				c.Printf("Failed validating orphan %s: %v", orphan.ID(), err)
+				c.quarantine(orphan, err)
+				continue
 			}
-			if err := c.AddAs(ancestor, c.subscriptionID); err != nil {
-				return fmt.Errorf("failed inserting ancestory %s into store: %w", ancestor.ID(), err)
+			if err := c.insert(orphan, ViaAnnounce); err != nil {
+				c.Printf("Failed inserting orphan %s into store: %v", orphan.ID(), err)
+				continue
 			}
+			c.Printf("Ingested orphan %s", orphan.ID())
+		}
+	}()
+}
+
+// ingestNode implements IngestNode without the orphan pool.
+func (c *Worker) ingestNode(node forest.Node) error {
+	timeout := c.DefaultTimeout
+	// the content policy judges the node alone, so consult it before
+	// fetching anything from the peer on the node's behalf
+	if err := c.allowIngest(node, ViaAnnounce); err != nil {
+		return fmt.Errorf("couldn't accept node %s: %w", node.ID(), err)
+	}
+	if err := c.ensureAuthorAvailable(node, timeout); err != nil {
+		return err
+	}
+	if err := node.ValidateDeep(c.SubscribableStore); err != nil {
+		// siblings share the same ancestry, so only fetch it once for all
+		// of the children of a given parent. Each worker asks its own peer,
+		// as another worker's peer may not have the ancestry.
+		if err := c.Inflight.Do(c.peerKey("ancestry", node.ParentID()), func() error {
+			return c.fetchAncestry(node, timeout)
+		}); err != nil {
+			return err
 		}
-		if err := node.ValidateDeep(c.SubscribableStore); err != nil {
-			return fmt.Errorf("failed validating %s after fetching ancestry: %w", node.ID(), err)
+	}
+	if err := c.validate(node, ViaAnnounce); err != nil {
+		return fmt.Errorf("failed validating %s: %w", node.ID(), err)
+	}
+	return c.insert(node, ViaAnnounce)
+}
+
+// fetchAncestry requests the ancestry of the given node from the peer and
+// validates and inserts each ancestor that isn't already in the local store.
+func (c *Worker) fetchAncestry(node forest.Node, timeout time.Duration) error {
+	ancestry, err := c.SendAncestry(node.ID(), int(node.TreeDepth()), makeTicker(timeout))
+	if err != nil {
+		return fmt.Errorf("validation unable to fetch ancestry for node %s: %w", node.ID(), err)
+	}
+	c.markKnown(ancestry.Nodes...)
+	for _, ancestor := range ancestry.Nodes {
+		if _, alreadyHas, err := c.SubscribableStore.Get(ancestor.ID()); err != nil {
+			return fmt.Errorf("unable to check whether %s is in local store: %w", ancestor.ID(), err)
+		} else if alreadyHas {
+			// we already have this ancestor, no need to validate it again
+			continue
+		}
+		if err := c.allowIngest(ancestor, ViaAncestry); err != nil {
+			return fmt.Errorf("couldn't accept ancestor %s: %w", ancestor.ID(), err)
+		}
+		if err := c.ensureAuthorAvailable(ancestor, timeout); err != nil {
+			return fmt.Errorf("validation unable to fetch author for ancestor %s: %w", ancestor.ID(), err)
+		}
+		if err := c.validate(ancestor, ViaAncestry); err != nil {
+			return fmt.Errorf("validation failed for ancestor %s: %w", ancestor.ID(), err)
+		}
+		if err := c.insert(ancestor, ViaAncestry); err != nil {
+			return fmt.Errorf("failed inserting ancestory %s into store: %w", ancestor.ID(), err)
 		}
 	}
-	return c.SubscribableStore.AddAs(node, c.subscriptionID)
+	return nil
 }
 
 func (c *Worker) OnAnnounce(s *Conn, messageID MessageID, nodes []forest.Node) error {
 	c.Printf("Received announce: id:%d quantity:%d", messageID, len(nodes))
+	c.markKnown(nodes...)
+	results := make(chan error, len(nodes))
+	ingesting, skipped := 0, 0
 	for _, node := range nodes {
 		// if we already have it, don't worry about it
 		// This ensures that we don't announce it again to our peers and create
 		// an infinite cycle of announcements
 		if _, alreadyInStore, err := c.SubscribableStore.Get(node.ID()); err != nil {
 			c.Printf("failed checking whether %s is already in the store: %v", node.ID(), err)
+			ingesting++
+			results <- err
 			continue
 		} else if alreadyInStore {
 			// we already have it
@@ -310,10 +774,11 @@ func (c *Worker) OnAnnounce(s *Conn, messageID MessageID, nodes []forest.Node) e
 		case *forest.Community:
 			shouldIngest = true
 		case *forest.Reply:
-			if c.Session.IsSubscribed(&n.CommunityID) {
+			if c.Session.IsLocallySubscribed(&n.CommunityID) {
 				shouldIngest = true
 			} else {
 				c.Printf("received annoucement for reply %s in non-subscribed community %s", n.ID().String(), n.CommunityID.String())
+				skipped++
 				continue
 			}
 		default:
@@ -322,16 +787,69 @@ func (c *Worker) OnAnnounce(s *Conn, messageID MessageID, nodes []forest.Node) e
 		}
 		if shouldIngest {
 			c.Printf("Ingesting node %s", node.ID())
+			ingesting++
 			go func(n forest.Node) {
-				if err := c.IngestNode(n); err != nil {
+				err := c.IngestNode(n)
+				results <- err
+				if err != nil {
 					c.Printf("Failed ingesting node %s: %v", n.ID().String(), err)
+					return
+				}
+				if community, isCommunity := n.(*forest.Community); isCommunity && c.SubscriptionPolicy != nil {
+					c.subscribeIfAllowed(community)
 				}
 			}(node)
 		} else {
 			c.Printf("Not ingesting node %s", node.ID())
 		}
 	}
-	return s.SendStatus(messageID, StatusOk)
+	if !c.SynchronousAnnounce {
+		return s.SendStatus(messageID, StatusOk)
+	}
+	// ingestion may need to send requests to the peer, so we must not block
+	// the goroutine reading messages while we wait for it
+	go func() {
+		status := c.awaitIngestion(results, ingesting, skipped)
+		if err := s.SendStatus(messageID, status); err != nil {
+			c.Printf("Failed sending status for announce %d: %v", messageID, err)
+		}
+	}()
+	return nil
+}
+
+// awaitIngestion collects count ingestion results (or as many as arrive
+// within the IngestTimeout) and returns the status that should be reported
+// for the announce message that triggered them, in which skipped further
+// nodes were not ingested because we are not interested in them. Nodes held
+// as orphans are not considered rejected.
+func (c *Worker) awaitIngestion(results <-chan error, count, skipped int) StatusCode {
+	timeout := time.NewTimer(c.IngestTimeout)
+	defer timeout.Stop()
+	rejected, failed := skipped, 0
+	for received := 0; received < count; received++ {
+		select {
+		case err := <-results:
+			switch {
+			case err == nil, errors.Is(err, ErrOrphaned):
+			case errors.Is(err, ErrPolicyViolation):
+				rejected++
+			default:
+				failed++
+			}
+		case <-timeout.C:
+			c.Printf("Timed out with %d of %d announced nodes still being ingested", count-received, count)
+			received = count
+		}
+	}
+	if failed > 0 {
+		c.Printf("Failed ingesting %d of %d announced nodes", failed, count+skipped)
+		return ErrorMalformed
+	}
+	if rejected > 0 {
+		c.Printf("Rejected %d of %d announced nodes", rejected, count+skipped)
+		return ErrorRejected
+	}
+	return StatusOk
 }
 
 // BootstrapLocalStore is a utility method for loading all available
@@ -342,7 +860,8 @@ func (c *Worker) OnAnnounce(s *Conn, messageID MessageID, nodes []forest.Node) e
 // - fetch the signing identities of those communities
 // - validate and insert those identities and communities into the
 //   worker's store
-// - subscribe to all of those communities
+// - subscribe to all of those communities permitted by the worker's
+//   SubscriptionPolicy
 // - fetch all leaves of those communities
 // - fetch the ancestry of each leaf and validate it (fetching identities as necessary), inserting nodes that pass valdiation into the store
 func (c *Worker) BootstrapLocalStore(maxCommunities int) {
@@ -357,19 +876,42 @@ func (c *Worker) BootstrapLocalStore(maxCommunities int) {
 			c.Printf("Got response in community list that isn't a community: %s", node.ID().String())
 			continue
 		}
+		if c.SubscriptionPolicy != nil && !c.ShouldSubscribe(community) {
+			c.Printf("Skipping community %s due to subscription policy", community.ID().String())
+			continue
+		}
+		if c.IsLocallySubscribed(community.ID()) {
+			// already subscribed (for instance by RestoreSession)
+			continue
+		}
+		if err := c.allowIngest(community, ViaBootstrap); err != nil {
+			c.Printf("Couldn't accept community %s: %v", community.ID().String(), err)
+			c.quarantine(community, err)
+			continue
+		}
 		if err := c.ensureAuthorAvailable(community, c.DefaultTimeout); err != nil {
 			c.Printf("Couldn't fetch author information for node %s: %v", community.ID().String(), err)
 			continue
 		}
-		if err := c.AddAs(community, c.subscriptionID); err != nil {
+		if err := c.validate(community, ViaBootstrap); err != nil {
+			c.Printf("Couldn't validate community %s: %v", community.ID().String(), err)
+			c.quarantine(community, err)
+			continue
+		}
+		if err := c.insert(community, ViaBootstrap); err != nil {
 			c.Printf("Couldn't add community %s to store: %v", community.ID().String(), err)
 			continue
 		}
-		if err := c.SendSubscribe(community, makeTicker(c.DefaultTimeout)); err != nil {
+		subscribed, err := c.subscribeOnce(community.ID(), func() error {
+			return c.SendSubscribe(community, makeTicker(c.DefaultTimeout))
+		})
+		if err != nil {
 			c.Printf("Couldn't subscribe to community %s", community.ID().String())
 			continue
+		} else if !subscribed {
+			// subscribed concurrently (for instance by UpstreamSubscriptions)
+			continue
 		}
-		c.Subscribe(community.ID())
 		c.Printf("Subscribed to %s", community.ID().String())
 		if err := c.fetchFullTree(community, maxCommunities, c.DefaultTimeout); err != nil {
 			c.Printf("Couldn't fetch message tree rooted at community %s: %v", community.ID().String(), err)
@@ -378,11 +920,186 @@ func (c *Worker) BootstrapLocalStore(maxCommunities int) {
 	}
 }
 
+// SubscribeToCommunity subscribes to the community with the given ID on the
+// peer and then fetches up to maxNodes leaves of that community's history
+// (along with their ancestry) into the local store. If the community node
+// itself is not in the local store, it is queried from the peer. It does
+// nothing if we are already subscribed to the community on the peer.
+func (c *Worker) SubscribeToCommunity(communityID *fields.QualifiedHash, maxNodes int) error {
+	subscribed, err := c.subscribeOnce(communityID, func() error {
+		return c.SendSubscribeByID(communityID, makeTicker(c.DefaultTimeout))
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't subscribe to community %s: %w", communityID.String(), err)
+	} else if !subscribed {
+		return nil
+	}
+	c.Printf("Subscribed to %s", communityID.String())
+	community, inStore, err := c.GetCommunity(communityID)
+	if err != nil {
+		return fmt.Errorf("failed looking for community %s in store: %w", communityID.String(), err)
+	}
+	if !inStore {
+		response, err := c.SendQuery([]*fields.QualifiedHash{communityID}, makeTicker(c.DefaultTimeout))
+		if err != nil {
+			return fmt.Errorf("failed querying for community %s: %w", communityID.String(), err)
+		}
+		if len(response.Nodes) != 1 {
+			return fmt.Errorf("query for single community id %s returned %d nodes", communityID.String(), len(response.Nodes))
+		}
+		c.markKnown(response.Nodes...)
+		community = response.Nodes[0]
+		if _, isCommunity := community.(*forest.Community); !isCommunity {
+			return fmt.Errorf("query for community id %s returned node of type %T", communityID.String(), community)
+		}
+		if err := c.allowIngest(community, ViaQuery); err != nil {
+			c.quarantine(community, err)
+			return fmt.Errorf("couldn't accept community %s: %w", communityID.String(), err)
+		}
+		if err := c.ensureAuthorAvailable(community, c.DefaultTimeout); err != nil {
+			return fmt.Errorf("couldn't fetch author for community %s: %w", communityID.String(), err)
+		}
+		if err := c.validate(community, ViaQuery); err != nil {
+			c.quarantine(community, err)
+			return fmt.Errorf("couldn't validate community %s: %w", communityID.String(), err)
+		}
+		if err := c.insert(community, ViaQuery); err != nil {
+			return fmt.Errorf("couldn't add community %s to store: %w", communityID.String(), err)
+		}
+	}
+	if err := c.fetchFullTree(community, maxNodes, c.DefaultTimeout); err != nil {
+		return fmt.Errorf("couldn't fetch message tree rooted at community %s: %w", communityID.String(), err)
+	}
+	return nil
+}
+
+// subscribeOnce subscribes to the given community on the peer by invoking
+// send and recording the subscription in the worker's Session, unless the
+// worker is already subscribed. It reports whether it subscribed. Changes to
+// the worker's subscriptions are serialized, so concurrent callers never
+// subscribe to the same community twice.
+func (c *Worker) subscribeOnce(communityID *fields.QualifiedHash, send func() error) (bool, error) {
+	c.subscriptionLock.Lock()
+	defer c.subscriptionLock.Unlock()
+	if c.IsLocallySubscribed(communityID) {
+		return false, nil
+	}
+	if err := send(); err != nil {
+		return false, err
+	}
+	c.SubscribeLocal(communityID)
+	return true, nil
+}
+
+// UnsubscribeFromCommunity unsubscribes from the community with the given ID
+// on the peer. It does nothing if we are not subscribed to the community.
+func (c *Worker) UnsubscribeFromCommunity(communityID *fields.QualifiedHash) error {
+	c.subscriptionLock.Lock()
+	defer c.subscriptionLock.Unlock()
+	if !c.IsLocallySubscribed(communityID) {
+		return nil
+	}
+	if err := c.SendUnsubscribeByID(communityID, makeTicker(c.DefaultTimeout)); err != nil {
+		return fmt.Errorf("couldn't unsubscribe from community %s: %w", communityID.String(), err)
+	}
+	c.UnsubscribeLocal(communityID)
+	c.Printf("Unsubscribed from %s", communityID.String())
+	return nil
+}
+
+// RestoreResult describes the outcome of Worker.RestoreSession.
+type RestoreResult struct {
+	// Resubscribed lists the communities that were subscribed to again.
+	Resubscribed []*fields.QualifiedHash
+	// Failed maps the string form of each community ID that could not be
+	// subscribed to again onto the error that prevented it.
+	Failed map[string]error
+	// Announced is the number of missed nodes announced to the peer.
+	Announced int
+	// AnnounceErr is the error (if any) encountered announcing missed nodes.
+	AnnounceErr error
+}
+
+// RestoreSession carries the state of a previous connection to the same peer
+// over to this worker. It re-subscribes to every community that the previous
+// session was subscribed to on the peer (fetching up to maxNodes leaves of
+// each to catch up on anything missed) and then announces the missed nodes
+// (usually collected with a Backlog) that belong to those communities.
+//
+// A Backlog should be stopped only once the worker is Ready, so that every
+// node added to the store is either in the backlog or announced by the
+// worker.
+//
+// Subscriptions that the peer held with us are not restored, as the peer is
+// responsible for subscribing again on a new connection.
+func (c *Worker) RestoreSession(previous *Session, missed []forest.Node, maxNodes int) RestoreResult {
+	result := RestoreResult{
+		Failed: make(map[string]error),
+	}
+	for _, community := range previous.LocalSubscriptions() {
+		if err := c.SubscribeToCommunity(community, maxNodes); err != nil {
+			result.Failed[community.String()] = err
+			continue
+		}
+		result.Resubscribed = append(result.Resubscribed, community)
+	}
+	toAnnounce := make([]forest.Node, 0, len(missed))
+	for _, node := range missed {
+		if c.knownNodes.Has(node.ID()) {
+			continue
+		}
+		switch n := node.(type) {
+		case *forest.Identity, *forest.Community:
+			toAnnounce = append(toAnnounce, n)
+		case *forest.Reply:
+			if c.IsLocallySubscribed(&n.CommunityID) || c.IsPeerSubscribed(&n.CommunityID) {
+				toAnnounce = append(toAnnounce, n)
+			}
+		}
+	}
+	if len(toAnnounce) > 0 {
+		announced, err := c.announceBatch(toAnnounce)
+		if err != nil {
+			result.AnnounceErr = fmt.Errorf("failed announcing missed nodes: %w", err)
+		}
+		result.Announced = announced
+	}
+	return result
+}
+
+// subscribeIfAllowed subscribes to the given community on the peer if the
+// worker's SubscriptionPolicy permits it.
+func (c *Worker) subscribeIfAllowed(community *forest.Community) {
+	if c.IsLocallySubscribed(community.ID()) {
+		return
+	}
+	if !c.ShouldSubscribe(community) {
+		c.Printf("Not subscribing to announced community %s due to subscription policy", community.ID().String())
+		return
+	}
+	subscribed, err := c.subscribeOnce(community.ID(), func() error {
+		return c.SendSubscribe(community, makeTicker(c.DefaultTimeout))
+	})
+	if err != nil {
+		c.Printf("Couldn't subscribe to community %s: %v", community.ID().String(), err)
+		return
+	} else if !subscribed {
+		return
+	}
+	c.Printf("Subscribed to %s", community.ID().String())
+}
+
+// fetchFullTree fetches up to maxNodes leaves of the given node along with
+// their ancestry and inserts them into the store. A leaf whose ancestry
+// contains a node that is forbidden by the content policy or invalid is
+// skipped (and the offending node quarantined); only failures to
+// communicate with the peer or to use the store abort the fetch.
 func (c *Worker) fetchFullTree(root forest.Node, maxNodes int, perRequestTimeout time.Duration) error {
 	leafList, err := c.SendLeavesOf(root.ID(), maxNodes, makeTicker(perRequestTimeout))
 	if err != nil {
 		return fmt.Errorf("couldn't fetch leaves of node %s: %v", root.ID().String(), err)
 	}
+	c.markKnown(leafList.Nodes...)
 	for _, leaf := range leafList.Nodes {
 		if _, alreadyInStore, err := c.Get(leaf.ID()); err != nil {
 			return fmt.Errorf("failed checking if we already have leaf node %s: %w", leaf.ID().String(), err)
@@ -393,25 +1110,248 @@ func (c *Worker) fetchFullTree(root forest.Node, maxNodes int, perRequestTimeout
 		if err != nil {
 			return fmt.Errorf("couldn't fetch ancestry of node %s: %v", leaf.ID().String(), err)
 		}
+		c.markKnown(ancestry.Nodes...)
 		sort.Slice(ancestry.Nodes, func(i, j int) bool {
 			return ancestry.Nodes[i].TreeDepth() < ancestry.Nodes[j].TreeDepth()
 		})
-		ancestry.Nodes = append(ancestry.Nodes, leaf)
+		chain := make([]forest.Node, 0, len(ancestry.Nodes)+1)
 		for _, ancestor := range ancestry.Nodes {
-			if err := c.ensureAuthorAvailable(ancestor, perRequestTimeout); err != nil {
-				return fmt.Errorf("couldn't fetch author for node %s: %w", ancestor.ID().String(), err)
+			if _, alreadyInStore, err := c.Get(ancestor.ID()); err != nil {
+				return fmt.Errorf("failed checking if we already have node %s: %w", ancestor.ID().String(), err)
+			} else if !alreadyInStore {
+				chain = append(chain, ancestor)
 			}
-			if err := ancestor.ValidateDeep(c.SubscribableStore); err != nil {
-				return fmt.Errorf("couldn't validate node %s: %w", ancestor.ID().String(), err)
+		}
+		chain = append(chain, leaf)
+		if err := c.fetchChain(chain, ViaBootstrap, perRequestTimeout); err != nil {
+			var rejected rejectedNodeError
+			if !errors.As(err, &rejected) {
+				return err
 			}
-			if err := c.AddAs(ancestor, c.subscriptionID); err != nil {
-				return fmt.Errorf("couldn't add node %s to store: %w", ancestor.ID().String(), err)
+			c.Printf("Skipping leaf %s: %v", leaf.ID().String(), err)
+		}
+	}
+	return nil
+}
+
+// rejectedNodeError reports that a node received from the peer is forbidden
+// by the content policy or invalid. Unlike failures to communicate with the
+// peer or to use the store, it concerns only that node and its descendants.
+type rejectedNodeError struct {
+	node forest.Node
+	err  error
+}
+
+func (r rejectedNodeError) Error() string {
+	return fmt.Sprintf("couldn't accept node %s: %v", r.node.ID().String(), r.err)
+}
+
+func (r rejectedNodeError) Unwrap() error {
+	return r.err
+}
+
+// reject quarantines the given node and returns a rejectedNodeError for it.
+func (c *Worker) reject(node forest.Node, reason error) error {
+	c.quarantine(node, reason)
+	return rejectedNodeError{node: node, err: reason}
+}
+
+// fetchChain checks the given nodes, none of which may be in the store yet,
+// against the content policy, fetches their authors, verifies their
+// signatures, and inserts them. The nodes must be a node preceded by its
+// ancestors, ordered so that parents precede their children; only the last
+// node is checked against the content policy in its own right. The policy is
+// consulted before anything is fetched from the peer.
+func (c *Worker) fetchChain(nodes []forest.Node, via ProvenanceSource, perRequestTimeout time.Duration) error {
+	for i, node := range nodes {
+		policyVia := via
+		if i < len(nodes)-1 {
+			policyVia = ViaAncestry
+		}
+		if err := c.allowIngest(node, policyVia); err != nil {
+			return c.reject(node, err)
+		}
+	}
+	for _, node := range nodes {
+		if err := c.ensureAuthorAvailable(node, perRequestTimeout); err != nil {
+			return fmt.Errorf("couldn't fetch author for node %s: %w", node.ID().String(), err)
+		}
+	}
+	// signatures can be checked in parallel once all authors are known,
+	// but parents must be inserted before their children validate
+	for i, err := range c.Validation.VerifyAll(nodes, c.SubscribableStore) {
+		if err != nil {
+			return c.reject(nodes[i], err)
+		}
+	}
+	return c.insertChain(nodes, via)
+}
+
+// insertChain validates the references of each of the given nodes (whose
+// signatures must already have been verified) and then inserts them into
+// the store. The nodes must be ordered so that parents precede their
+// children. If the store supports batch insertion, none of the nodes are
+// inserted unless all of them are valid.
+func (c *Worker) insertChain(nodes []forest.Node, via ProvenanceSource) error {
+	batcher, canBatch := c.SubscribableStore.(batchAdder)
+	var (
+		pending              = forest.NewMemoryStore()
+		overlay forest.Store = c.SubscribableStore
+	)
+	if canBatch {
+		// nodes earlier in the chain are visible to the validation of
+		// later ones through this overlay before any of them are inserted
+		cache, err := forest.NewCacheStore(pending, c.SubscribableStore)
+		if err != nil {
+			return fmt.Errorf("couldn't prepare to validate nodes: %w", err)
+		}
+		overlay = cache
+	}
+	batch := make([]forest.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if _, alreadyInStore, err := c.Get(node.ID()); err != nil {
+			return fmt.Errorf("failed checking if we already have node %s: %w", node.ID().String(), err)
+		} else if alreadyInStore {
+			continue
+		}
+		if err := node.ValidateDeep(overlay); err != nil {
+			return c.reject(node, err)
+		}
+		if !canBatch {
+			if err := c.insert(node, via); err != nil {
+				return fmt.Errorf("couldn't add node %s to store: %w", node.ID().String(), err)
 			}
+			continue
+		}
+		if err := pending.Add(node); err != nil {
+			return fmt.Errorf("couldn't stage node %s: %w", node.ID().String(), err)
+		}
+		batch = append(batch, node)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := batcher.AddAllAs(batch, c.subscriptionID); err != nil {
+		return fmt.Errorf("couldn't add %d nodes to store: %w", len(batch), err)
+	}
+	c.recordProvenance(batch, via)
+	return nil
+}
+
+// validate checks the given node against the worker's ContentPolicy, checks
+// its signature using the worker's ValidationPool, and then checks that the
+// nodes it references are present in the store.
+func (c *Worker) validate(node forest.Node, via ProvenanceSource) error {
+	if err := c.allowIngest(node, via); err != nil {
+		return err
+	}
+	if err := c.Validation.Verify(node, c.SubscribableStore); err != nil {
+		return err
+	}
+	return node.ValidateDeep(c.SubscribableStore)
+}
+
+// allowIngest consults the worker's ContentPolicy (if any) about inserting
+// the given node, received as described by via, into the store.
+func (c *Worker) allowIngest(node forest.Node, via ProvenanceSource) error {
+	if c.ContentPolicy == nil {
+		return nil
+	}
+	if via == ViaAncestry {
+		return allowIngestAncestor(c.ContentPolicy, node)
+	}
+	return c.AllowIngest(node)
+}
+
+// servable filters out the nodes that the worker's ContentPolicy (if any)
+// forbids sending to the peer.
+func (c *Worker) servable(nodes []forest.Node) []forest.Node {
+	if c.ContentPolicy == nil {
+		return nodes
+	}
+	return c.filterServable(nodes, c.AllowServe)
+}
+
+// servableAncestors filters out the nodes that the worker's ContentPolicy
+// (if any) forbids sending to the peer as the ancestors of another node.
+func (c *Worker) servableAncestors(nodes []forest.Node) []forest.Node {
+	if c.ContentPolicy == nil {
+		return nodes
+	}
+	return c.filterServable(nodes, func(node forest.Node) error {
+		return allowServeAncestor(c.ContentPolicy, node)
+	})
+}
+
+// filterServable returns the nodes that the given check allows sending to
+// the peer.
+func (c *Worker) filterServable(nodes []forest.Node, allow func(forest.Node) error) []forest.Node {
+	allowed := make([]forest.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if err := allow(node); err != nil {
+			c.Printf("Not serving node %s: %v", node.ID(), err)
+			continue
 		}
+		allowed = append(allowed, node)
+	}
+	return allowed
+}
+
+// insert adds the given node to the store and records its provenance.
+func (c *Worker) insert(node forest.Node, via ProvenanceSource) error {
+	if err := c.AddAs(node, c.subscriptionID); err != nil {
+		return err
 	}
+	c.recordProvenance([]forest.Node{node}, via)
 	return nil
 }
 
+// recordProvenance notes that the given nodes were received from the peer.
+func (c *Worker) recordProvenance(nodes []forest.Node, via ProvenanceSource) {
+	if c.Provenance == nil {
+		return
+	}
+	now := time.Now()
+	for _, node := range nodes {
+		c.Provenance.Record(node.ID(), Provenance{
+			Peer: c.PeerAddress,
+			Time: now,
+			Via:  via,
+		})
+	}
+}
+
+// quarantine records the given node as rejected for the given reason in the
+// worker's Quarantine (if any).
+func (c *Worker) quarantine(node forest.Node, reason error) {
+	if c.Quarantine == nil {
+		return
+	}
+	if err := c.Quarantine.Add(node, reason, c.PeerAddress); err != nil {
+		c.Printf("Failed quarantining node %s: %v", node.ID(), err)
+	}
+}
+
+// markKnown records that the peer has the given nodes, so that they will
+// not be announced to it.
+func (c *Worker) markKnown(nodes ...forest.Node) {
+	ids := make([]*fields.QualifiedHash, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID()
+	}
+	c.knownNodes.Add(ids...)
+}
+
+// peerHost returns the host of the given address, or the whole address if
+// it has no port.
+func peerHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 func makeTicker(duration time.Duration) <-chan time.Time {
 	return time.NewTicker(duration).C
 }
@@ -436,19 +1376,53 @@ func (c *Worker) ensureAuthorAvailable(node forest.Node, perRequestTimeout time.
 	if inStore {
 		return nil
 	}
-	response, err := c.SendQuery([]*fields.QualifiedHash{authorID}, makeTicker(perRequestTimeout))
-	if err != nil {
-		return fmt.Errorf("failed querying for author %s: %w", authorID.String(), err)
-	}
-	if len(response.Nodes) != 1 {
-		return fmt.Errorf("query for single author id %s returned %d nodes", authorID.String(), len(response.Nodes))
-	}
-	author := response.Nodes[0]
-	if err := author.ValidateDeep(c.SubscribableStore); err != nil {
-		return fmt.Errorf("unable to validate author %s: %w", author.ID().String(), err)
+	fetch := func() error {
+		// another fetch of this author may have completed since we checked
+		if _, inStore, err := c.GetIdentity(authorID); err != nil {
+			return fmt.Errorf("failed looking for author id %s in store: %w", authorID.String(), err)
+		} else if inStore {
+			return nil
+		}
+		response, err := c.SendQuery([]*fields.QualifiedHash{authorID}, makeTicker(perRequestTimeout))
+		if err != nil {
+			return fmt.Errorf("failed querying for author %s: %w", authorID.String(), err)
+		}
+		if len(response.Nodes) != 1 {
+			return fmt.Errorf("query for single author id %s returned %d nodes", authorID.String(), len(response.Nodes))
+		}
+		c.markKnown(response.Nodes...)
+		author := response.Nodes[0]
+		if err := c.validate(author, ViaQuery); err != nil {
+			return c.reject(author, err)
+		}
+		if err := c.insert(author, ViaQuery); err != nil {
+			return fmt.Errorf("failed inserting new valid author %s into store: %w", author.ID().String(), err)
+		}
+		return nil
 	}
-	if err := c.AddAs(author, c.subscriptionID); err != nil {
-		return fmt.Errorf("failed inserting new valid author %s into store: %w", author.ID().String(), err)
+	return c.doShared("author", authorID, fetch)
+}
+
+// doShared runs fn through the worker's Inflight group, sharing the result
+// with concurrent calls for the same operation on the same node. If it
+// instead waited for another call that failed, it runs fn itself, as the
+// other call may have been made by a worker whose peer lacked nodes that
+// ours has.
+func (c *Worker) doShared(operation string, id *fields.QualifiedHash, fn func() error) error {
+	ran := false
+	err := c.Inflight.Do(operation+" "+id.String(), func() error {
+		ran = true
+		return fn()
+	})
+	if err != nil && !ran {
+		return c.Inflight.Do(c.peerKey(operation, id), fn)
 	}
-	return nil
+	return err
+}
+
+// peerKey builds an Inflight key for an operation on the given node that
+// depends upon this worker's peer, so that it is only shared with other
+// operations on the same connection.
+func (c *Worker) peerKey(operation string, id *fields.QualifiedHash) string {
+	return fmt.Sprintf("%s %p %s", operation, c, id)
 }
@@ -0,0 +1,728 @@
+package sprout_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	forest "git.sr.ht/~whereswaldon/forest-go"
+	"git.sr.ht/~whereswaldon/forest-go/fields"
+	"git.sr.ht/~whereswaldon/forest-go/testkeys"
+	sprout "git.sr.ht/~whereswaldon/sprout-go"
+)
+
+// workerPair is two Workers connected to each other, each with its own
+// store.
+type workerPair struct {
+	local, remote           *sprout.Worker
+	localStore, remoteStore *sprout.SubscriberStore
+	stopped                 chan struct{}
+}
+
+// newWorkerPair connects two workers over an in-memory connection. The
+// configure function, if any, is invoked before the workers are run.
+func newWorkerPair(t *testing.T, configure func(local, remote *sprout.Worker)) *workerPair {
+	return connectStores(t, sprout.NewSubscriberStore(forest.NewMemoryStore()), sprout.NewSubscriberStore(forest.NewMemoryStore()), configure)
+}
+
+// connectStores is like newWorkerPair, but the workers use the given
+// stores.
+func connectStores(t *testing.T, localStore, remoteStore *sprout.SubscriberStore, configure func(local, remote *sprout.Worker)) *workerPair {
+	localConn, remoteConn := net.Pipe()
+	p := &workerPair{
+		localStore:  localStore,
+		remoteStore: remoteStore,
+		stopped:     make(chan struct{}, 2),
+	}
+	var err error
+	done := make(chan struct{})
+	if p.local, err = sprout.NewWorker(done, localConn, p.localStore); err != nil {
+		t.Fatalf("failed creating local worker: %v", err)
+	}
+	if p.remote, err = sprout.NewWorker(done, remoteConn, p.remoteStore); err != nil {
+		t.Fatalf("failed creating remote worker: %v", err)
+	}
+	for _, w := range []*sprout.Worker{p.local, p.remote} {
+		w.Logger = log.New(ioutil.Discard, "", 0)
+		w.DefaultTimeout = 5 * time.Second
+	}
+	if configure != nil {
+		configure(p.local, p.remote)
+	}
+	for _, w := range []*sprout.Worker{p.local, p.remote} {
+		go func(w *sprout.Worker) {
+			w.Run()
+			p.stopped <- struct{}{}
+		}(w)
+	}
+	for _, w := range []*sprout.Worker{p.local, p.remote} {
+		select {
+		case <-w.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for workers to subscribe to their stores")
+		}
+	}
+	return p
+}
+
+// Stop disconnects the workers and waits for them to exit.
+func (p *workerPair) Stop() {
+	p.local.Conn.Conn.Close()
+	p.remote.Conn.Conn.Close()
+	<-p.stopped
+	<-p.stopped
+}
+
+// eventually fails the test if the condition does not hold within a few
+// seconds.
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// inStore returns a condition that holds once the store contains every
+// given node.
+func inStore(store forest.Store, nodes ...forest.Node) func() bool {
+	return func() bool {
+		for _, node := range nodes {
+			if _, has, _ := store.Get(node.ID()); !has {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestWorkerAnnounceBatching(t *testing.T) {
+	identity, community, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceBatchSize = 2
+		// only a full batch can trigger a flush
+		local.AnnounceInterval = time.Hour
+	})
+	defer p.Stop()
+	if err := p.localStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	eventually(t, "announced nodes to arrive", inStore(p.remoteStore, identity, community))
+	eventually(t, "announce to complete", func() bool {
+		return p.local.AnnounceStats().Announced == 2
+	})
+	if stats := p.local.AnnounceStats(); stats.Batches != 1 || stats.Queued != 2 || stats.Dropped != 0 {
+		t.Fatalf("expected a single batch of 2 nodes, got %+v", stats)
+	}
+}
+
+func TestWorkerAnnounceWithoutInterval(t *testing.T) {
+	identity, _, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceBatchSize = 100
+		local.AnnounceInterval = 0
+	})
+	defer p.Stop()
+	if err := p.localStore.Add(identity); err != nil {
+		t.Fatalf("failed adding identity: %v", err)
+	}
+	eventually(t, "identity to be announced immediately", inStore(p.remoteStore, identity))
+}
+
+func TestWorkerDropsUnsentAnnouncementsOnStop(t *testing.T) {
+	identity, community, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceBatchSize = 100
+		local.AnnounceInterval = time.Hour
+	})
+	if err := p.localStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	eventually(t, "nodes to be queued", func() bool {
+		return p.local.AnnounceStats().Queued == 2
+	})
+	p.Stop()
+	eventually(t, "unsent nodes to be counted as dropped", func() bool {
+		return p.local.AnnounceStats().Dropped == 2
+	})
+	if stats := p.local.AnnounceStats(); stats.Announced != 0 || stats.Batches != 0 {
+		t.Fatalf("expected nothing to be announced, got %+v", stats)
+	}
+}
+
+// rejectIngest is a ContentPolicy that refuses to ingest any node.
+type rejectIngest struct{}
+
+func (rejectIngest) AllowIngest(forest.Node) error {
+	return sprout.ErrPolicyViolation
+}
+
+func (rejectIngest) AllowServe(forest.Node) error {
+	return nil
+}
+
+func TestWorkerSuppressesKnownNodes(t *testing.T) {
+	identity, community, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceInterval = 0
+		remote.AnnounceInterval = 0
+		// keep the announced nodes out of the remote store so that they can
+		// arrive there from another source
+		remote.ContentPolicy = rejectIngest{}
+	})
+	defer p.Stop()
+	if err := p.localStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	eventually(t, "announce to complete", func() bool {
+		return p.local.AnnounceStats().Announced == 2
+	})
+	// the peer announced these nodes, so they must not be announced back
+	if err := p.remoteStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	eventually(t, "nodes to be suppressed", func() bool {
+		return p.remote.AnnounceStats().Suppressed == 2
+	})
+	if stats := p.remote.AnnounceStats(); stats.Queued != 0 || stats.Batches != 0 {
+		t.Fatalf("expected nothing to be announced back, got %+v", stats)
+	}
+}
+
+func TestWorkerAdoptsOrphans(t *testing.T) {
+	identity, community, reply := testTree(t)
+	p := newWorkerPair(t, nil)
+	defer p.Stop()
+	// the peer can supply the reply's author but not its community
+	for _, node := range []forest.Node{identity, reply} {
+		if err := p.localStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if err := p.remote.IngestNode(reply); !errors.Is(err, sprout.ErrOrphaned) {
+		t.Fatalf("expected reply to be orphaned, got %v", err)
+	}
+	if count := p.remote.OrphanCount(); count != 1 {
+		t.Fatalf("expected 1 orphan, got %d", count)
+	}
+	// the community arriving from any source resolves the orphan
+	if err := p.remoteStore.Add(community); err != nil {
+		t.Fatalf("failed adding community: %v", err)
+	}
+	eventually(t, "orphan to be ingested", inStore(p.remoteStore, reply))
+	if count := p.remote.OrphanCount(); count != 0 {
+		t.Fatalf("expected no orphans, got %d", count)
+	}
+}
+
+func TestWorkerExpiresOrphans(t *testing.T) {
+	identity, community, reply := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.OrphanTimeout = 10 * time.Millisecond
+	})
+	defer p.Stop()
+	for _, node := range []forest.Node{identity, reply} {
+		if err := p.localStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	if err := p.remote.IngestNode(reply); !errors.Is(err, sprout.ErrOrphaned) {
+		t.Fatalf("expected reply to be orphaned, got %v", err)
+	}
+	eventually(t, "orphan to expire", func() bool {
+		return p.remote.OrphanCount() == 0
+	})
+	if err := p.remoteStore.Add(community); err != nil {
+		t.Fatalf("failed adding community: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, has, _ := p.remoteStore.Get(reply.ID()); has {
+		t.Fatalf("expected expired orphan not to be ingested")
+	}
+}
+
+func TestWorkerDeduplicatesFetches(t *testing.T) {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	builder := forest.As(identity, signer)
+	community, err := builder.NewCommunity(randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	nodes := []forest.Node{identity, community}
+	var replies []forest.Node
+	for i := 0; i < 10; i++ {
+		reply, err := builder.NewReply(community, randomString(12), "")
+		if err != nil {
+			t.Fatalf("failed creating reply: %v", err)
+		}
+		replies = append(replies, reply)
+	}
+	var queries, ancestries int32
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.Conn.OnQuery = func(s *sprout.Conn, id sprout.MessageID, ids []*fields.QualifiedHash) error {
+			atomic.AddInt32(&queries, 1)
+			return local.OnQuery(s, id, ids)
+		}
+		local.Conn.OnAncestry = func(s *sprout.Conn, id sprout.MessageID, nodeID *fields.QualifiedHash, levels int) error {
+			atomic.AddInt32(&ancestries, 1)
+			return local.OnAncestry(s, id, nodeID, levels)
+		}
+	})
+	defer p.Stop()
+	if err := p.localStore.AddAll(append(nodes, replies...)); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	var wg sync.WaitGroup
+	for _, reply := range replies {
+		wg.Add(1)
+		go func(reply forest.Node) {
+			defer wg.Done()
+			if err := p.remote.IngestNode(reply); err != nil {
+				t.Errorf("failed ingesting reply: %v", err)
+			}
+		}(reply)
+	}
+	wg.Wait()
+	// every reply shares an author and a parent
+	if q, a := atomic.LoadInt32(&queries), atomic.LoadInt32(&ancestries); q != 1 || a != 1 {
+		t.Fatalf("expected 1 author query and 1 ancestry request, got %d and %d", q, a)
+	}
+}
+
+func TestWorkerRetriesSharedFetchWithOwnPeer(t *testing.T) {
+	identity, community, _ := testTree(t)
+	inflight := sprout.NewInflightGroup()
+	queried := make(chan struct{})
+	release := make(chan struct{})
+	// the first pair's peer does not have the author, and answers slowly
+	first := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.Inflight = inflight
+		local.Conn.OnQuery = func(s *sprout.Conn, id sprout.MessageID, ids []*fields.QualifiedHash) error {
+			close(queried)
+			<-release
+			return local.OnQuery(s, id, ids)
+		}
+	})
+	defer first.Stop()
+	second := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.Inflight = inflight
+	})
+	defer second.Stop()
+	if err := second.localStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+
+	firstResult := make(chan error, 1)
+	go func() {
+		firstResult <- first.remote.IngestNode(community)
+	}()
+	<-queried
+	secondResult := make(chan error, 1)
+	go func() {
+		secondResult <- second.remote.IngestNode(community)
+	}()
+	// give the second ingest time to wait on the first one's author fetch
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-secondResult; err != nil {
+		t.Fatalf("expected second worker to fetch the author from its own peer, got %v", err)
+	}
+	<-firstResult
+	eventually(t, "community to be ingested", inStore(second.remoteStore, identity, community))
+}
+
+func TestWorkerValidatesTreeWithPool(t *testing.T) {
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	identity, err := forest.NewIdentity(signer, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating identity: %v", err)
+	}
+	builder := forest.As(identity, signer)
+	community, err := builder.NewCommunity(randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating community: %v", err)
+	}
+	nodes := []forest.Node{identity, community}
+	var parent interface{} = community
+	for i := 0; i < 5; i++ {
+		reply, err := builder.NewReply(parent, randomString(12), "")
+		if err != nil {
+			t.Fatalf("failed creating reply: %v", err)
+		}
+		nodes = append(nodes, reply)
+		parent = reply
+	}
+	pool := sprout.NewValidationPool(2)
+	defer pool.Stop()
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.Validation = pool
+	})
+	defer p.Stop()
+	if err := p.localStore.AddAll(nodes); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	if err := p.remote.SubscribeToCommunity(community.ID(), 10); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	eventually(t, "the whole tree to be fetched", inStore(p.remoteStore, nodes...))
+}
+
+func TestWorkerFollowsSubscriptionPolicy(t *testing.T) {
+	allowedIdentity, allowed, allowedReply := testTree(t)
+	deniedIdentity, denied, deniedReply := testTree(t)
+	announcedAllowedIdentity, announcedAllowed, _ := testTree(t)
+	announcedDeniedIdentity, announcedDenied, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceInterval = 0
+		remote.SubscriptionPolicy = sprout.AllowCommunities(allowed.ID(), announcedAllowed.ID())
+		// add the initial history before the workers run, so that it is
+		// only available to bootstrap
+		for _, node := range []forest.Node{allowedIdentity, allowed, allowedReply, deniedIdentity, denied, deniedReply} {
+			if err := local.SubscribableStore.Add(node); err != nil {
+				t.Fatalf("failed adding node: %v", err)
+			}
+		}
+	})
+	defer p.Stop()
+
+	p.remote.BootstrapLocalStore(10)
+	if !p.remote.IsLocallySubscribed(allowed.ID()) || p.remote.IsLocallySubscribed(denied.ID()) {
+		t.Fatalf("expected bootstrap to subscribe only to the allowed community")
+	}
+	if !inStore(p.remoteStore, allowed, allowedReply)() {
+		t.Fatalf("expected bootstrap to fetch the history of the allowed community")
+	}
+	if inStore(p.remoteStore, denied)() || inStore(p.remoteStore, deniedReply)() {
+		t.Fatalf("expected bootstrap to skip the denied community")
+	}
+
+	for _, node := range []forest.Node{announcedAllowedIdentity, announcedAllowed, announcedDeniedIdentity, announcedDenied} {
+		if err := p.localStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	eventually(t, "announced communities to arrive", inStore(p.remoteStore, announcedAllowed, announcedDenied))
+	eventually(t, "subscription to the allowed announced community", func() bool {
+		return p.remote.IsLocallySubscribed(announcedAllowed.ID())
+	})
+	// subscribing to the denied community would have happened by now
+	time.Sleep(50 * time.Millisecond)
+	if p.remote.IsLocallySubscribed(announcedDenied.ID()) {
+		t.Fatalf("expected not to subscribe to the denied announced community")
+	}
+}
+
+func TestWorkerRestoresSession(t *testing.T) {
+	identity, community, reply := testTree(t)
+	relayStore := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	peerStore := sprout.NewSubscriberStore(forest.NewMemoryStore())
+	if err := peerStore.AddAll([]forest.Node{identity, community}); err != nil {
+		t.Fatalf("failed adding nodes: %v", err)
+	}
+	first := connectStores(t, relayStore, peerStore, nil)
+	if err := first.local.SubscribeToCommunity(community.ID(), 10); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	first.Stop()
+	previous := first.local.Session
+	backlog := sprout.RecordBacklog(relayStore, 10)
+
+	// the reply is added while disconnected
+	if err := relayStore.Add(reply); err != nil {
+		t.Fatalf("failed adding reply: %v", err)
+	}
+	second := connectStores(t, relayStore, peerStore, nil)
+	defer second.Stop()
+	// the peer subscribes again on its own, without fetching any history
+	if err := second.remote.SubscribeToCommunity(community.ID(), 0); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	missed, complete := backlog.Stop()
+	if !complete || len(missed) != 1 || !missed[0].Equals(reply) {
+		t.Fatalf("expected the backlog to hold the reply, got %d nodes (complete: %v)", len(missed), complete)
+	}
+	result := second.local.RestoreSession(previous, missed, 10)
+	if len(result.Resubscribed) != 1 || !result.Resubscribed[0].Equals(community.ID()) || len(result.Failed) != 0 {
+		t.Fatalf("expected to resubscribe to the community, got %+v", result)
+	}
+	if result.Announced != 1 || result.AnnounceErr != nil {
+		t.Fatalf("expected to announce the missed reply, got %+v", result)
+	}
+	if !second.remote.IsPeerSubscribed(community.ID()) {
+		t.Fatalf("expected the peer to see the restored subscription")
+	}
+	eventually(t, "the missed reply to reach the peer", inStore(peerStore, reply))
+}
+
+func TestWorkerSkipsRejectedLeaves(t *testing.T) {
+	identity, community, allowedReply := testTree(t)
+	blockedIdentity, _, _ := testTree(t)
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	blockedReply, err := forest.As(blockedIdentity, signer).NewReply(community, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating reply: %v", err)
+	}
+	otherReply, err := forest.As(identity, signer).NewReply(community, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating reply: %v", err)
+	}
+	quarantine, err := sprout.NewQuarantine("")
+	if err != nil {
+		t.Fatalf("failed creating quarantine: %v", err)
+	}
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.ContentPolicy = sprout.NewIdentityBlocklist(blockedIdentity.ID())
+		remote.Quarantine = quarantine
+		for _, node := range []forest.Node{identity, community, allowedReply, blockedIdentity, blockedReply, otherReply} {
+			if err := local.SubscribableStore.Add(node); err != nil {
+				t.Fatalf("failed adding node: %v", err)
+			}
+		}
+	})
+	defer p.Stop()
+
+	if err := p.remote.SubscribeToCommunity(community.ID(), 10); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	if !inStore(p.remoteStore, allowedReply, otherReply)() {
+		t.Fatalf("expected the allowed leaves to be fetched")
+	}
+	if _, has := quarantine.Get(blockedReply.ID()); !has || inStore(p.remoteStore, blockedReply)() {
+		t.Fatalf("expected the blocked leaf to be quarantined")
+	}
+	// the policy rejects the leaf before its author is fetched
+	if inStore(p.remoteStore, blockedIdentity)() {
+		t.Fatalf("expected the author of the blocked leaf not to be fetched")
+	}
+}
+
+func TestWorkerAppliesIngestPolicy(t *testing.T) {
+	identity, community, _ := testTree(t)
+	blockedIdentity, blocked, _ := testTree(t)
+	quarantine, err := sprout.NewQuarantine("")
+	if err != nil {
+		t.Fatalf("failed creating quarantine: %v", err)
+	}
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		local.AnnounceInterval = 0
+		remote.ContentPolicy = sprout.NewCommunityBlocklist(blocked.ID())
+		remote.Quarantine = quarantine
+		// the author of the blocked community is only available on request
+		if err := local.SubscribableStore.Add(blockedIdentity); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	})
+	defer p.Stop()
+
+	for _, node := range []forest.Node{blocked, identity, community} {
+		if err := p.localStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	eventually(t, "the allowed community to arrive", inStore(p.remoteStore, identity, community))
+	eventually(t, "the blocked community to be quarantined", func() bool {
+		_, has := quarantine.Get(blocked.ID())
+		return has
+	})
+	if inStore(p.remoteStore, blocked)() {
+		t.Fatalf("expected the blocked community not to be ingested")
+	}
+	// the policy rejects the community before its author is fetched
+	if inStore(p.remoteStore, blockedIdentity)() {
+		t.Fatalf("expected the author of the blocked community not to be fetched")
+	}
+}
+
+func TestWorkerFiltersServedTimestamps(t *testing.T) {
+	for _, filterServe := range []bool{false, true} {
+		identity, community, reply := testTree(t)
+		p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+			local.ContentPolicy = sprout.TimestampPolicy{MaxAge: 50 * time.Millisecond, FilterServe: filterServe}
+			for _, node := range []forest.Node{identity, community, reply} {
+				if err := local.SubscribableStore.Add(node); err != nil {
+					t.Fatalf("failed adding node: %v", err)
+				}
+			}
+		})
+		// let the reply grow too old to be served
+		time.Sleep(100 * time.Millisecond)
+		if err := p.remote.SubscribeToCommunity(community.ID(), 10); err != nil {
+			t.Fatalf("failed subscribing to community: %v", err)
+		}
+		if !inStore(p.remoteStore, identity, community)() {
+			t.Fatalf("expected the community to be served")
+		}
+		if served := inStore(p.remoteStore, reply)(); served == filterServe {
+			t.Fatalf("expected the stale reply to be served: %v, got %v", !filterServe, served)
+		}
+		p.Stop()
+	}
+}
+
+func TestWorkerPeerAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed listening: %v", err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed dialing: %v", err)
+	}
+	defer conn.Close()
+	worker, err := sprout.NewWorker(make(chan struct{}), conn, sprout.NewSubscriberStore(forest.NewMemoryStore()))
+	if err != nil {
+		t.Fatalf("failed creating worker: %v", err)
+	}
+	// the port differs between connections from the same peer
+	if worker.PeerAddress != "127.0.0.1" {
+		t.Fatalf("expected the peer to be identified by its host, got %q", worker.PeerAddress)
+	}
+}
+
+func TestWorkerSynchronousAnnounce(t *testing.T) {
+	identity, community, reply := testTree(t)
+	_, otherCommunity, otherReply := testTree(t)
+	blockedIdentity, blocked, _ := testTree(t)
+	p := newWorkerPair(t, func(local, remote *sprout.Worker) {
+		remote.SynchronousAnnounce = true
+		remote.ContentPolicy = sprout.NewCommunityBlocklist(blocked.ID())
+		// the nodes are announced by hand below, so that the announcements
+		// can be observed
+		for _, node := range []forest.Node{identity, community, reply, blockedIdentity, blocked, otherCommunity, otherReply} {
+			if err := local.SubscribableStore.Add(node); err != nil {
+				t.Fatalf("failed adding node: %v", err)
+			}
+		}
+	})
+	defer p.Stop()
+	announce := func(nodes ...forest.Node) error {
+		return p.local.SendAnnounce(nodes, time.NewTicker(5*time.Second).C)
+	}
+
+	if err := announce(identity, community); err != nil {
+		t.Fatalf("expected the announce to succeed, got %v", err)
+	}
+	// the reply is sent only once the nodes are in the store
+	if !inStore(p.remoteStore, identity, community)() {
+		t.Fatalf("expected the announced nodes to be ingested before the reply")
+	}
+
+	var status sprout.Status
+	if err := announce(blocked); !errors.As(err, &status) || status.Code != sprout.ErrorRejected {
+		t.Fatalf("expected a node refused by the content policy to be rejected, got %v", err)
+	}
+	// the community of the reply is not subscribed to, so it is not ingested
+	if err := announce(otherReply); !errors.As(err, &status) || status.Code != sprout.ErrorRejected {
+		t.Fatalf("expected a reply in an unsubscribed community to be rejected, got %v", err)
+	}
+	if err := p.remote.SubscribeToCommunity(community.ID(), 0); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	if err := announce(reply); err != nil {
+		t.Fatalf("expected a reply in a subscribed community to be accepted, got %v", err)
+	}
+	if inStore(p.remoteStore, blocked)() || inStore(p.remoteStore, otherReply)() || !inStore(p.remoteStore, reply)() {
+		t.Fatalf("expected only the accepted nodes to be stored")
+	}
+}
+
+// newIndexedPair is like newWorkerPair, but the remote worker's store is
+// indexed and holds the given nodes.
+func newIndexedPair(t *testing.T, configure func(local, remote *sprout.Worker), nodes ...forest.Node) *workerPair {
+	index := sprout.NewTreeIndex()
+	remoteStore := sprout.NewSubscriberStore(sprout.NewIndexingStore(forest.NewMemoryStore(), index))
+	for _, node := range nodes {
+		if err := remoteStore.Add(node); err != nil {
+			t.Fatalf("failed adding node: %v", err)
+		}
+	}
+	return connectStores(t, sprout.NewSubscriberStore(forest.NewMemoryStore()), remoteStore, func(local, remote *sprout.Worker) {
+		remote.Index = index
+		if configure != nil {
+			configure(local, remote)
+		}
+	})
+}
+
+func TestWorkerIndexedLeaves(t *testing.T) {
+	identity, community, parent := testTree(t)
+	signer := testkeys.Signer(t, testkeys.PrivKey1)
+	builder := forest.As(identity, signer)
+	time.Sleep(2 * time.Millisecond)
+	shallow, err := builder.NewReply(community, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating reply: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	deep, err := builder.NewReply(parent, randomString(12), "")
+	if err != nil {
+		t.Fatalf("failed creating reply: %v", err)
+	}
+	p := newIndexedPair(t, nil, identity, community, parent, shallow, deep)
+	defer p.Stop()
+
+	// the newest leaf is the deepest, so a walk of the store would not
+	// find it first
+	leaves, err := p.local.SendLeavesOf(community.ID(), 1, time.NewTicker(5*time.Second).C)
+	if err != nil {
+		t.Fatalf("failed fetching leaves: %v", err)
+	}
+	if len(leaves.Nodes) != 1 || !leaves.Nodes[0].Equals(deep) {
+		t.Fatalf("expected the newest leaf, got %v", leaves.Nodes)
+	}
+	leaves, err = p.local.SendLeavesOf(community.ID(), 10, time.NewTicker(5*time.Second).C)
+	if err != nil {
+		t.Fatalf("failed fetching leaves: %v", err)
+	}
+	if len(leaves.Nodes) != 2 || !leaves.Nodes[0].Equals(deep) || !leaves.Nodes[1].Equals(shallow) {
+		t.Fatalf("expected the leaves newest first, got %v", leaves.Nodes)
+	}
+	leaves, err = p.local.SendLeavesOf(parent.ID(), 10, time.NewTicker(5*time.Second).C)
+	if err != nil {
+		t.Fatalf("failed fetching leaves: %v", err)
+	}
+	if len(leaves.Nodes) != 1 || !leaves.Nodes[0].Equals(deep) {
+		t.Fatalf("expected only the leaf below the reply, got %v", leaves.Nodes)
+	}
+}
+
+func TestWorkerScopesReplyLists(t *testing.T) {
+	identity, community, reply := testTree(t)
+	otherIdentity, otherCommunity, otherReply := testTree(t)
+	p := newIndexedPair(t, func(local, remote *sprout.Worker) {
+		remote.ScopeReplyLists = true
+	}, identity, community, reply, otherIdentity, otherCommunity, otherReply)
+	defer p.Stop()
+
+	list := func() []forest.Node {
+		t.Helper()
+		response, err := p.local.SendList(fields.NodeTypeReply, 10, time.NewTicker(5*time.Second).C)
+		if err != nil {
+			t.Fatalf("failed listing replies: %v", err)
+		}
+		return response.Nodes
+	}
+	// without subscriptions, every reply is listed
+	if replies := list(); len(replies) != 2 {
+		t.Fatalf("expected both replies to be listed, got %d", len(replies))
+	}
+	if err := p.local.SubscribeToCommunity(community.ID(), 0); err != nil {
+		t.Fatalf("failed subscribing to community: %v", err)
+	}
+	if replies := list(); len(replies) != 1 || !replies[0].Equals(reply) {
+		t.Fatalf("expected only the reply in the subscribed community, got %v", replies)
+	}
+}